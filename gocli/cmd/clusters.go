@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"github.com/docker/docker/client"
+	"github.com/spf13/cobra"
+	"kubevirt.io/kubevirtci/gocli/docker"
+)
+
+func NewClustersCommand() *cobra.Command {
+
+	clusters := &cobra.Command{
+		Use:   "clusters",
+		Short: "clusters lists the prefixes of all clusters, one per line",
+		RunE:  clusters,
+		Args:  cobra.NoArgs,
+	}
+	return clusters
+}
+
+func clusters(cmd *cobra.Command, args []string) error {
+
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return err
+	}
+
+	return docker.WriteClusterPrefixes(cli, cmd.OutOrStdout())
+}
@@ -5,7 +5,6 @@ import (
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/mount"
-	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
 	"github.com/spf13/cobra"
@@ -102,7 +101,8 @@ func provision(cmd *cobra.Command, args []string) error {
 
 	// Start dnsmasq
 	dnsmasq, err := cli.ContainerCreate(ctx, &container.Config{
-		Image: base,
+		Image:  base,
+		Labels: docker.ClusterLabels(prefix),
 		Env: []string{
 			fmt.Sprintf("NUM_NODES=1"),
 		},
@@ -127,9 +127,7 @@ func provision(cmd *cobra.Command, args []string) error {
 	nodeName := nodeNameFromIndex(1)
 	nodeNum := fmt.Sprintf("%02d", 1)
 
-	vol, err := cli.VolumeCreate(ctx, volume.VolumesCreateBody{
-		Name: fmt.Sprintf("%s-%s", prefix, nodeName),
-	})
+	vol, err := docker.CreateVolume(ctx, cli, prefix, nodeName)
 	if err != nil {
 		return err
 	}
@@ -138,7 +136,8 @@ func provision(cmd *cobra.Command, args []string) error {
 		qemu_args = "--qemu-args " + qemu_args
 	}
 	node, err := cli.ContainerCreate(ctx, &container.Config{
-		Image: base,
+		Image:  base,
+		Labels: docker.ClusterLabels(prefix),
 		Env: []string{
 			fmt.Sprintf("NODE_NUM=%s", nodeNum),
 		},
@@ -179,7 +178,7 @@ func provision(cmd *cobra.Command, args []string) error {
 	}
 
 	//check if we have a special provision script
-	success, err = docker.Exec(cli, nodeContainer(prefix, nodeName), []string{"/bin/bash", "-c", fmt.Sprintf("test -f /scripts/provision.sh", nodeName)}, os.Stdout)
+	success, err = docker.Exec(cli, nodeContainer(prefix, nodeName), []string{"/bin/bash", "-c", "test -f /scripts/provision.sh"}, os.Stdout)
 	if err != nil {
 		return fmt.Errorf("checking for a provision script failed failed: %v", err)
 	}
@@ -6,6 +6,7 @@ import (
 	"github.com/spf13/cobra"
 	"golang.org/x/net/context"
 	"kubevirt.io/kubevirtci/gocli/docker"
+	"strings"
 )
 
 func NewRemoveCommand() *cobra.Command {
@@ -31,6 +32,12 @@ func rm(cmd *cobra.Command, _ []string) error {
 		return err
 	}
 
+	release, err := docker.AcquireClusterLock(context.Background(), cli, prefix)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	containers, err := docker.GetPrefixedContainers(cli, prefix+"-")
 	if err != nil {
 		return err
@@ -43,11 +50,26 @@ func rm(cmd *cobra.Command, _ []string) error {
 		}
 	}
 
-	volumes, err := docker.GetPrefixedVolumes(cli, prefix)
+	volumes, err := docker.GetVolumesByLabels(context.Background(), cli, map[string]string{docker.LABEL_CLUSTER: prefix})
 	if err != nil {
 		return err
 	}
 
+	// Volumes created before they got labelled can only be found by their name
+	prefixedVolumes, err := docker.GetPrefixedVolumes(cli, prefix+"-")
+	if err != nil {
+		return err
+	}
+	for _, v := range prefixedVolumes {
+		// The lock volumes of other clusters can share the prefix, and the lock of this one is released on return
+		if _, lock := v.Labels[docker.LABEL_LOCK]; lock {
+			continue
+		}
+		if _, labelled := v.Labels[docker.LABEL_CLUSTER]; !labelled && strings.HasPrefix(v.Name, prefix+"-") {
+			volumes = append(volumes, v)
+		}
+	}
+
 	for _, v := range volumes {
 		err := cli.VolumeRemove(context.Background(), v.Name, true)
 		if err != nil {
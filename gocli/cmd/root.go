@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"github.com/spf13/cobra"
+	"kubevirt.io/kubevirtci/gocli/docker"
 	"os"
 )
 
@@ -20,13 +21,25 @@ func NewRootCommand() *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			fmt.Fprint(cmd.OutOrStderr(), cmd.UsageString())
 		},
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			byLabel, err := cmd.Flags().GetBool("select-by-label")
+			if err != nil {
+				return err
+			}
+			if byLabel {
+				docker.SetSelectionMode(docker.ByLabel)
+			}
+			return nil
+		},
 		SilenceUsage:  true,
 		SilenceErrors: true,
 	}
 
 	root.PersistentFlags().StringP("prefix", "p", "kubevirt", "Prefix to identify docker containers")
+	root.PersistentFlags().Bool("select-by-label", false, "Identify docker containers and volumes by their cluster label instead of their name")
 
 	root.AddCommand(
+		NewClustersCommand(),
 		NewPortCommand(),
 		NewRemoveCommand(),
 		NewRunCommand(),
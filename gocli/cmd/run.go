@@ -5,10 +5,11 @@ import (
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/api/types/strslice"
-	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
+	"github.com/docker/go-units"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"golang.org/x/net/context"
@@ -16,7 +17,9 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -43,6 +46,30 @@ func NewRunCommand() *cobra.Command {
 	run.Flags().Uint("ssh-port", 0, "port on localhost for ssh server")
 	run.Flags().String("nfs-data", "", "path to data which should be exposed via nfs to the nodes")
 	run.Flags().String("log-to-dir", "", "enables aggregated cluster logging to the folder")
+	run.Flags().StringSlice("cap-add", []string{}, "linux capabilities to add to the nodes")
+	run.Flags().StringSlice("cap-drop", []string{}, "linux capabilities to drop from the nodes")
+	run.Flags().Bool("privileged", true, "run the nodes privileged, capabilities and devices can only be configured for unprivileged nodes")
+	run.Flags().StringSlice("network", []string{}, "additional docker networks on which the cluster is reachable, the node VMs keep their single nic on the cluster bridge")
+	run.Flags().StringSlice("network-alias", []string{}, "names of the whole cluster on the additional networks, like control-plane, which forward the ssh ports of all nodes and the api ports of node01")
+	run.Flags().String("shm-size", "", "size of /dev/shm on the nodes, like 512M")
+	run.Flags().Bool("keep", false, "keep all containers and volumes on failure for debugging")
+	run.Flags().Int("oom-score-adj", 0, "oom score adjustment of the nodes, higher values make them preferred by the OOM killer")
+	run.Flags().Int("dnsmasq-oom-score-adj", 0, "oom score adjustment of the dnsmasq container, which keeps the cluster network")
+	run.Flags().String("stop-signal", "", "signal to stop the nodes with, like SIGRTMIN+3")
+	run.Flags().Int64("pids-limit", 0, "maximum number of processes per node, -1 for unlimited")
+	run.Flags().StringSlice("gpu-device", []string{}, "host gpu devices to pass through to the nodes, like /dev/nvidia0")
+	run.Flags().String("runtime", "", "container runtime for the nodes, like nvidia")
+	run.Flags().StringSlice("dns-option", []string{}, "resolv.conf options for the cluster containers, like ndots:2")
+	run.Flags().StringSlice("sysctl", []string{}, "namespaced sysctls for the cluster containers, like net.ipv4.ip_forward=1")
+	run.Flags().String("http-proxy", "", "http proxy for the nodes and docker inside the nodes")
+	run.Flags().String("https-proxy", "", "https proxy for the nodes and docker inside the nodes")
+	run.Flags().String("no-proxy", "", "comma separated list of hosts which are reached without proxy")
+	run.Flags().StringSlice("node-mount", []string{}, "host directories to bind mount into the nodes, like /data:/data or /data:/data:rshared")
+	run.Flags().Bool("init", false, "run an init process in the nodes which reaps zombie processes")
+	run.Flags().String("cgroup-parent", "", "parent cgroup for all cluster containers")
+	run.Flags().StringSlice("device", []string{}, "host devices to expose to the nodes, like /dev/kvm or /dev/net/tun:/dev/net/tun:rwm")
+	run.Flags().Bool("skip-preflight", false, "start the cluster even if the preflight checks fail")
+	run.Flags().String("userns", "", "user namespace mode of the nodes, host opts out of the user namespace remapping of the daemon")
 	return run
 }
 
@@ -106,6 +133,161 @@ func run(cmd *cobra.Command, args []string) (err error) {
 		return err
 	}
 
+	capAdd, err := cmd.Flags().GetStringSlice("cap-add")
+	if err != nil {
+		return err
+	}
+
+	capDrop, err := cmd.Flags().GetStringSlice("cap-drop")
+	if err != nil {
+		return err
+	}
+
+	privileged, err := cmd.Flags().GetBool("privileged")
+	if err != nil {
+		return err
+	}
+
+	networks, err := cmd.Flags().GetStringSlice("network")
+	if err != nil {
+		return err
+	}
+
+	networkAliases, err := cmd.Flags().GetStringSlice("network-alias")
+	if err != nil {
+		return err
+	}
+	if len(networkAliases) > 0 && len(networks) == 0 {
+		return fmt.Errorf("network aliases need at least one additional network")
+	}
+
+	shmSize := int64(0)
+	shmSizeString, err := cmd.Flags().GetString("shm-size")
+	if err != nil {
+		return err
+	}
+	if shmSizeString != "" {
+		shmSize, err = units.RAMInBytes(shmSizeString)
+		if err != nil {
+			return fmt.Errorf("invalid shm size %s: %v", shmSizeString, err)
+		}
+	}
+
+	keep, err := cmd.Flags().GetBool("keep")
+	if err != nil {
+		return err
+	}
+
+	oomScoreAdj, err := cmd.Flags().GetInt("oom-score-adj")
+	if err != nil {
+		return err
+	}
+
+	dnsmasqOomScoreAdj, err := cmd.Flags().GetInt("dnsmasq-oom-score-adj")
+	if err != nil {
+		return err
+	}
+
+	stopSignal, err := cmd.Flags().GetString("stop-signal")
+	if err != nil {
+		return err
+	}
+
+	pidsLimit, err := cmd.Flags().GetInt64("pids-limit")
+	if err != nil {
+		return err
+	}
+
+	gpuDevices, err := cmd.Flags().GetStringSlice("gpu-device")
+	if err != nil {
+		return err
+	}
+
+	runtime, err := cmd.Flags().GetString("runtime")
+	if err != nil {
+		return err
+	}
+
+	dnsOptions, err := cmd.Flags().GetStringSlice("dns-option")
+	if err != nil {
+		return err
+	}
+
+	sysctlFlags, err := cmd.Flags().GetStringSlice("sysctl")
+	if err != nil {
+		return err
+	}
+	netSysctls, nodeSysctls, err := splitSysctls(sysctlFlags)
+	if err != nil {
+		return err
+	}
+
+	httpProxy, err := cmd.Flags().GetString("http-proxy")
+	if err != nil {
+		return err
+	}
+
+	httpsProxy, err := cmd.Flags().GetString("https-proxy")
+	if err != nil {
+		return err
+	}
+
+	noProxy, err := cmd.Flags().GetString("no-proxy")
+	if err != nil {
+		return err
+	}
+	proxyEnv := docker.ProxyEnv(httpProxy, httpsProxy, noProxy)
+
+	nodeMountFlags, err := cmd.Flags().GetStringSlice("node-mount")
+	if err != nil {
+		return err
+	}
+	nodeMounts, err := bindMounts(nodeMountFlags)
+	if err != nil {
+		return err
+	}
+
+	// Only override the daemon default if the flag was explicitly set
+	var nodeInit *bool
+	if cmd.Flags().Changed("init") {
+		init, err := cmd.Flags().GetBool("init")
+		if err != nil {
+			return err
+		}
+		nodeInit = &init
+	}
+
+	cgroupParent, err := cmd.Flags().GetString("cgroup-parent")
+	if err != nil {
+		return err
+	}
+
+	deviceFlags, err := cmd.Flags().GetStringSlice("device")
+	if err != nil {
+		return err
+	}
+	devices, err := deviceMappings(deviceFlags)
+	if err != nil {
+		return err
+	}
+	if err := checkPrivilegedConflicts(privileged, capAdd, capDrop, gpuDevices, devices); err != nil {
+		return err
+	}
+
+	skipPreflight, err := cmd.Flags().GetBool("skip-preflight")
+	if err != nil {
+		return err
+	}
+
+	userns, err := cmd.Flags().GetString("userns")
+	if err != nil {
+		return err
+	}
+	usernsMode := container.UsernsMode(userns)
+	if !usernsMode.Valid() {
+		return fmt.Errorf("invalid user namespace mode %s", userns)
+	}
+
 	cluster := args[0]
 
 	background, err := cmd.Flags().GetBool("background")
@@ -120,7 +302,20 @@ func run(cmd *cobra.Command, args []string) (err error) {
 
 	ctx := context.Background()
 
-	containers, volumes, done := docker.NewCleanupHandler(cli, cmd.OutOrStderr())
+	// Keep concurrent gocli invocations off the cluster while it is created
+	release, err := docker.AcquireClusterLock(ctx, cli, prefix)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if !skipPreflight {
+		if err := preflight(ctx, cli, portMap); err != nil {
+			return err
+		}
+	}
+
+	containers, volumes, done := docker.NewCleanupHandlerWithOptions(cli, cmd.OutOrStderr(), docker.CleanupOptions{Keep: keep})
 
 	defer func() {
 		done <- err
@@ -130,7 +325,7 @@ func run(cmd *cobra.Command, args []string) (err error) {
 		interrupt := make(chan os.Signal, 1)
 		signal.Notify(interrupt, os.Interrupt)
 		<-interrupt
-		done <- fmt.Errorf("Interrupt received, clean up")
+		done <- docker.ErrCleanupRequested{Reason: "Interrupt received, clean up"}
 	}()
 
 	// Pull the cluster image
@@ -140,20 +335,27 @@ func run(cmd *cobra.Command, args []string) (err error) {
 	}
 	docker.PrintProgress(reader, os.Stdout)
 
+	exposedPorts := nat.PortSet{
+		tcpPortOrDie(PORT_SSH):      {},
+		tcpPortOrDie(PORT_REGISTRY): {},
+		tcpPortOrDie(PORT_OCP):      {},
+		tcpPortOrDie(PORT_K8S):      {},
+		tcpPortOrDie(PORT_VNC):      {},
+	}
+	// vm.sh forwards port 22<node number> to the ssh server of every node, PORT_SSH is the one of node01
+	for x := 1; x < int(nodes); x++ {
+		exposedPorts[tcpPortOrDie(PORT_SSH+x)] = struct{}{}
+	}
+
 	// Start dnsmasq
 	dnsmasq, err := cli.ContainerCreate(ctx, &container.Config{
-		Image: cluster,
+		Image:  cluster,
+		Labels: docker.ClusterLabels(prefix),
 		Env: []string{
 			fmt.Sprintf("NUM_NODES=%d", nodes),
 		},
-		Cmd: []string{"/bin/bash", "-c", "/dnsmasq.sh"},
-		ExposedPorts: nat.PortSet{
-			tcpPortOrDie(PORT_SSH):      {},
-			tcpPortOrDie(PORT_REGISTRY): {},
-			tcpPortOrDie(PORT_OCP):      {},
-			tcpPortOrDie(PORT_K8S):      {},
-			tcpPortOrDie(PORT_VNC):      {},
-		},
+		Cmd:          []string{"/bin/bash", "-c", "/dnsmasq.sh"},
+		ExposedPorts: exposedPorts,
 	}, &container.HostConfig{
 		Privileged:      true,
 		PublishAllPorts: random_ports,
@@ -162,15 +364,36 @@ func run(cmd *cobra.Command, args []string) (err error) {
 			"nfs:192.168.66.2",
 			"registry:192.168.66.2",
 		},
+		OomScoreAdj: dnsmasqOomScoreAdj,
+		// Nodes share the network namespace and with it the resolv.conf of dnsmasq
+		DNSOptions: dnsOptions,
+		Sysctls:    netSysctls,
+		Resources: container.Resources{
+			CgroupParent: cgroupParent,
+		},
 	}, nil, prefix+"-dnsmasq")
 	if err != nil {
 		return err
 	}
 	containers <- dnsmasq.ID
+
+	// Nodes share the network namespace of dnsmasq, so the cluster can only be made reachable on additional networks
+	// through it. The VMs behind the bridge do not get an additional nic, they are not multi-homed. The aliases
+	// name the dnsmasq endpoint and with it the whole cluster, not a single node.
+	for _, networkName := range networks {
+		if err := cli.NetworkConnect(ctx, networkName, dnsmasq.ID, &network.EndpointSettings{Aliases: networkAliases}); err != nil {
+			return err
+		}
+	}
+
 	if err := cli.ContainerStart(ctx, dnsmasq.ID, types.ContainerStartOptions{}); err != nil {
 		return err
 	}
 
+	if err := forwardNodePorts(ctx, cli, dnsmasq.ID, networks, int(nodes)); err != nil {
+		return err
+	}
+
 	// Pull the registry image
 	reader, err = cli.ImagePull(ctx, "docker.io/library/registry:2", types.ImagePullOptions{})
 	if err != nil {
@@ -182,9 +405,7 @@ func run(cmd *cobra.Command, args []string) (err error) {
 	var registryMounts []mount.Mount
 	if registry_volume != "" {
 
-		vol, err := cli.VolumeCreate(ctx, volume.VolumesCreateBody{
-			Name: fmt.Sprintf("%s-%s", prefix, "registry"),
-		})
+		vol, err := docker.CreateVolume(ctx, cli, prefix, "registry")
 		if err != nil {
 			return err
 		}
@@ -199,11 +420,15 @@ func run(cmd *cobra.Command, args []string) (err error) {
 
 	// Start registry
 	registry, err := cli.ContainerCreate(ctx, &container.Config{
-		Image: "registry:2",
+		Image:  "registry:2",
+		Labels: docker.ClusterLabels(prefix),
 	}, &container.HostConfig{
 		Mounts:      registryMounts,
 		Privileged:  true, // fixme we just need proper selinux volume labeling
 		NetworkMode: container.NetworkMode("container:" + dnsmasq.ID),
+		Resources: container.Resources{
+			CgroupParent: cgroupParent,
+		},
 	}, nil, prefix+"-registry")
 	if err != nil {
 		return err
@@ -227,7 +452,8 @@ func run(cmd *cobra.Command, args []string) (err error) {
 
 		// Start the ganesha image
 		nfsServer, err := cli.ContainerCreate(ctx, &container.Config{
-			Image: "janeczku/nfs-ganesha",
+			Image:  "janeczku/nfs-ganesha",
+			Labels: docker.ClusterLabels(prefix),
 		}, &container.HostConfig{
 			Mounts: []mount.Mount{
 				{
@@ -238,6 +464,9 @@ func run(cmd *cobra.Command, args []string) (err error) {
 			},
 			Privileged:  true,
 			NetworkMode: container.NetworkMode("container:" + dnsmasq.ID),
+			Resources: container.Resources{
+				CgroupParent: cgroupParent,
+			},
 		}, nil, prefix+"-nfs-ganesha")
 		if err != nil {
 			return err
@@ -267,7 +496,8 @@ func run(cmd *cobra.Command, args []string) (err error) {
 
 		// Start the fluent image
 		fluentd, err := cli.ContainerCreate(ctx, &container.Config{
-			Image: "docker.io/fluent/fluentd:v1.2-debian",
+			Image:  "docker.io/fluent/fluentd:v1.2-debian",
+			Labels: docker.ClusterLabels(prefix),
 			Cmd: strslice.StrSlice{
 				"exec fluentd",
 				"-i \"<system>\n log_level debug\n</system>\n<source>\n@type  forward\n@log_level error\nport  24224\n</source>\n<match **>\n@type file\npath /fluentd/log/collected\n</match>\"",
@@ -283,6 +513,9 @@ func run(cmd *cobra.Command, args []string) (err error) {
 			},
 			Privileged:  true,
 			NetworkMode: container.NetworkMode("container:" + dnsmasq.ID),
+			Resources: container.Resources{
+				CgroupParent: cgroupParent,
+			},
 		}, nil, prefix+"-fluentd")
 		if err != nil {
 			return err
@@ -305,9 +538,7 @@ func run(cmd *cobra.Command, args []string) (err error) {
 			nodeNum = fmt.Sprintf("%02d", (int(nodes) - x))
 		}
 
-		vol, err := cli.VolumeCreate(ctx, volume.VolumesCreateBody{
-			Name: fmt.Sprintf("%s-%s", prefix, nodeName),
-		})
+		vol, err := docker.CreateVolume(ctx, cli, prefix, nodeName)
 		if err != nil {
 			return err
 		}
@@ -317,24 +548,39 @@ func run(cmd *cobra.Command, args []string) (err error) {
 			qemu_args = "--qemu-args " + qemu_args
 		}
 		node, err := cli.ContainerCreate(ctx, &container.Config{
-			Image: cluster,
-			Env: []string{
+			Image:  cluster,
+			Labels: docker.ClusterLabels(prefix),
+			Env: append([]string{
 				fmt.Sprintf("NODE_NUM=%s", nodeNum),
-			},
+			}, proxyEnv...),
 			Volumes: map[string]struct{}{
 				"/var/run/disk/": {},
 			},
-			Cmd: []string{"/bin/bash", "-c", fmt.Sprintf("/vm.sh -n /var/run/disk/disk.qcow2 --memory %s --cpu %s %s", memory, strconv.Itoa(int(cpu)), qemu_args)},
+			Cmd:        []string{"/bin/bash", "-c", fmt.Sprintf("/vm.sh -n /var/run/disk/disk.qcow2 --memory %s --cpu %s %s", memory, strconv.Itoa(int(cpu)), qemu_args)},
+			StopSignal: stopSignal,
 		}, &container.HostConfig{
-			Mounts: []mount.Mount{
+			Mounts: append([]mount.Mount{
 				{
 					Type:   "volume",
 					Source: vol.Name,
 					Target: "/var/run/disk",
 				},
-			},
-			Privileged:  true,
+			}, nodeMounts...),
+			Privileged:  privileged,
 			NetworkMode: container.NetworkMode("container:" + dnsmasq.ID),
+			CapAdd:      strslice.StrSlice(capAdd),
+			CapDrop:     strslice.StrSlice(capDrop),
+			ShmSize:     shmSize,
+			OomScoreAdj: oomScoreAdj,
+			Resources: container.Resources{
+				PidsLimit:    pidsLimit,
+				Devices:      append(gpuDeviceMappings(gpuDevices), devices...),
+				CgroupParent: cgroupParent,
+			},
+			Runtime:    runtime,
+			Sysctls:    nodeSysctls,
+			Init:       nodeInit,
+			UsernsMode: usernsMode,
 		}, nil, prefix+"-"+nodeName)
 		if err != nil {
 			return err
@@ -354,6 +600,12 @@ func run(cmd *cobra.Command, args []string) (err error) {
 			return fmt.Errorf("checking for ssh.sh script for node %s failed", nodeName)
 		}
 
+		if len(proxyEnv) > 0 {
+			if err := docker.ConfigureDockerProxy(ctx, cli, nodeContainer(prefix, nodeName), proxyEnv); err != nil {
+				return err
+			}
+		}
+
 		//check if we have a special provision script
 		success, err = docker.Exec(cli, nodeContainer(prefix, nodeName), []string{"/bin/bash", "-c", fmt.Sprintf("test -f /scripts/%s.sh", nodeName)}, os.Stdout)
 		if err != nil {
@@ -380,6 +632,15 @@ func run(cmd *cobra.Command, args []string) (err error) {
 		}(node.ID)
 	}
 
+	// The ssh server of node01 is up now, so the aliases have to reach it
+	if len(networkAliases) > 0 {
+		for _, networkName := range networks {
+			if err := docker.CheckPortReachable(ctx, cli, cluster, networkName, networkAliases[0], PORT_SSH); err != nil {
+				return err
+			}
+		}
+	}
+
 	// If logging is enabled, deploy the default fluent logging
 	if logDir != "" {
 		nodeName := nodeNameFromIndex(1)
@@ -399,7 +660,7 @@ func run(cmd *cobra.Command, args []string) (err error) {
 	// If background flag was specified, we don't want to clean up if we reach that state
 	if !background {
 		wg.Wait()
-		done <- fmt.Errorf("Done. please clean up")
+		done <- docker.ErrCleanupRequested{Reason: "Done. please clean up"}
 	}
 
 	return nil
@@ -413,6 +674,209 @@ func nodeContainer(prefix string, node string) string {
 	return prefix + "-" + node
 }
 
+func gpuDeviceMappings(devices []string) []container.DeviceMapping {
+	mappings := []container.DeviceMapping{}
+	for _, device := range devices {
+		mappings = append(mappings, container.DeviceMapping{
+			PathOnHost:        device,
+			PathInContainer:   device,
+			CgroupPermissions: "rwm",
+		})
+	}
+	return mappings
+}
+
+// deviceMappings parses devices in the form host[:container[:permissions]]
+func deviceMappings(specs []string) ([]container.DeviceMapping, error) {
+	mappings := []container.DeviceMapping{}
+	for _, spec := range specs {
+		parts := strings.Split(spec, ":")
+		if len(parts) > 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid device %s, expected host[:container[:permissions]]", spec)
+		}
+		mapping := container.DeviceMapping{
+			PathOnHost:        parts[0],
+			PathInContainer:   parts[0],
+			CgroupPermissions: "rwm",
+		}
+		if len(parts) > 1 {
+			mapping.PathInContainer = parts[1]
+		}
+		if len(parts) > 2 {
+			mapping.CgroupPermissions = parts[2]
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings, nil
+}
+
+// forwardNodePorts makes the node ports reachable on the additional networks of dnsmasq. vm.sh only
+// forwards them from eth0, the interface of the default network.
+func forwardNodePorts(ctx context.Context, cli *client.Client, dnsmasq string, networks []string, nodes int) error {
+	if len(networks) == 0 {
+		return nil
+	}
+	details, err := cli.ContainerInspect(ctx, dnsmasq)
+	if err != nil {
+		return err
+	}
+
+	rules := []string{}
+	for _, networkName := range networks {
+		ip := ""
+		// Networks are listed by name, but can be passed by ID too
+		for name, endpoint := range details.NetworkSettings.Networks {
+			if name == networkName || endpoint.NetworkID == networkName {
+				ip = endpoint.IPAddress
+			}
+		}
+		if ip == "" {
+			return fmt.Errorf("dnsmasq has no address on network %s", networkName)
+		}
+		rules = append(rules, nodePortForwards(ip, nodes)...)
+	}
+
+	success, err := docker.ExecWithContext(ctx, cli, dnsmasq, []string{"/bin/bash", "-c", strings.Join(rules, " && ")}, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if !success {
+		return fmt.Errorf("forwarding the node ports on the additional networks failed")
+	}
+	return nil
+}
+
+// nodePortForwards returns the iptables commands which forward the node ports like vm.sh does, but for
+// connections to ip instead of connections through eth0
+func nodePortForwards(ip string, nodes int) []string {
+	forward := func(port int, node int, nodePort int) string {
+		return fmt.Sprintf("iptables -t nat -A PREROUTING -p tcp -d %s -m tcp --dport %d -j DNAT --to-destination 192.168.66.1%02d:%d", ip, port, node, nodePort)
+	}
+
+	rules := []string{}
+	for x := 1; x <= nodes; x++ {
+		rules = append(rules, forward(PORT_SSH+x-1, x, 22))
+	}
+	rules = append(rules, forward(PORT_K8S, 1, PORT_K8S), forward(PORT_OCP, 1, PORT_OCP))
+	return rules
+}
+
+// checkPrivilegedConflicts rejects capability and device settings for privileged nodes. Privileged
+// containers get all capabilities and see all host devices, docker ignores these settings for them.
+func checkPrivilegedConflicts(privileged bool, capAdd []string, capDrop []string, gpuDevices []string, devices []container.DeviceMapping) error {
+	if !privileged {
+		return nil
+	}
+	conflicts := []string{}
+	if len(capAdd) > 0 {
+		conflicts = append(conflicts, "--cap-add")
+	}
+	if len(capDrop) > 0 {
+		conflicts = append(conflicts, "--cap-drop")
+	}
+	if len(gpuDevices) > 0 {
+		conflicts = append(conflicts, "--gpu-device")
+	}
+	if len(devices) > 0 {
+		conflicts = append(conflicts, "--device")
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%s can not be used with privileged nodes, use --privileged=false", strings.Join(conflicts, ", "))
+	}
+	return nil
+}
+
+// splitSysctls separates net.* sysctls, which have to be set on dnsmasq since the nodes share its network namespace
+func splitSysctls(sysctls []string) (net map[string]string, node map[string]string, err error) {
+	net = map[string]string{}
+	node = map[string]string{}
+	for _, sysctl := range sysctls {
+		parts := strings.SplitN(sysctl, "=", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("invalid sysctl %s, expected key=value", sysctl)
+		}
+		if strings.HasPrefix(parts[0], "net.") {
+			net[parts[0]] = parts[1]
+		} else {
+			node[parts[0]] = parts[1]
+		}
+	}
+	return net, node, nil
+}
+
+// bindMounts parses mounts in the form source:target[:propagation]
+func bindMounts(specs []string) ([]mount.Mount, error) {
+	mounts := []mount.Mount{}
+	for _, spec := range specs {
+		parts := strings.Split(spec, ":")
+		if len(parts) != 2 && len(parts) != 3 {
+			return nil, fmt.Errorf("invalid mount %s, expected source:target[:propagation]", spec)
+		}
+
+		source, err := filepath.Abs(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		m := mount.Mount{
+			Type:   mount.TypeBind,
+			Source: source,
+			Target: parts[1],
+		}
+
+		if len(parts) == 3 {
+			propagation := mount.Propagation(parts[2])
+			valid := false
+			for _, p := range mount.Propagations {
+				valid = valid || p == propagation
+			}
+			if !valid {
+				return nil, fmt.Errorf("invalid mount propagation %s in mount %s", parts[2], spec)
+			}
+			m.BindOptions = &mount.BindOptions{Propagation: propagation}
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
+
+// preflight checks that the host can run a cluster before anything is created
+func preflight(ctx context.Context, cli *client.Client, portMap nat.PortMap) error {
+	ports := []int{}
+	for _, bindings := range portMap {
+		for _, binding := range bindings {
+			port, err := strconv.Atoi(binding.HostPort)
+			if err != nil {
+				return err
+			}
+			// Port 0 lets docker pick a free port
+			if port > 0 {
+				ports = append(ports, port)
+			}
+		}
+	}
+	sort.Ints(ports)
+
+	results, err := docker.PreflightChecks(ctx, cli, docker.PreflightOptions{
+		RequireKVM:    true,
+		Ports:         ports,
+		MinAPIVersion: cli.ClientVersion(),
+	})
+	if err != nil {
+		return err
+	}
+
+	failed := []string{}
+	for _, result := range results {
+		if !result.Passed && !result.Skipped {
+			failed = append(failed, fmt.Sprintf("  %s: %s", result.Name, result.Message))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("preflight checks failed, use --skip-preflight to ignore them:\n%s", strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
 func appendIfExplicit(ports nat.PortMap, exposedPort int, flagSet *pflag.FlagSet, flagName string) error {
 	flag := flagSet.Lookup(flagName)
 	if flag != nil && flag.Changed {
@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitSysctls(t *testing.T) {
+	tests := []struct {
+		name     string
+		sysctls  []string
+		wantNet  map[string]string
+		wantNode map[string]string
+		wantErr  bool
+	}{
+		{
+			name:     "none",
+			sysctls:  []string{},
+			wantNet:  map[string]string{},
+			wantNode: map[string]string{},
+		},
+		{
+			name:     "network and node sysctls",
+			sysctls:  []string{"net.ipv4.ip_forward=1", "kernel.shmmax=68719476736", "fs.mqueue.msg_max=100"},
+			wantNet:  map[string]string{"net.ipv4.ip_forward": "1"},
+			wantNode: map[string]string{"kernel.shmmax": "68719476736", "fs.mqueue.msg_max": "100"},
+		},
+		{
+			name:     "value containing =",
+			sysctls:  []string{"net.ipv4.ping_group_range=0 2147483647", "kernel.msg=a=b"},
+			wantNet:  map[string]string{"net.ipv4.ping_group_range": "0 2147483647"},
+			wantNode: map[string]string{"kernel.msg": "a=b"},
+		},
+		{
+			name:    "missing value",
+			sysctls: []string{"net.ipv4.ip_forward"},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			net, node, err := splitSysctls(test.sysctls)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("expected error %v, got %v", test.wantErr, err)
+			}
+			if test.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(net, test.wantNet) {
+				t.Errorf("expected network sysctls %v, got %v", test.wantNet, net)
+			}
+			if !reflect.DeepEqual(node, test.wantNode) {
+				t.Errorf("expected node sysctls %v, got %v", test.wantNode, node)
+			}
+		})
+	}
+}
+
+func TestBindMounts(t *testing.T) {
+	relative, err := filepath.Abs("data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		spec    string
+		want    mount.Mount
+		wantErr bool
+	}{
+		{spec: "/data:/mnt", want: mount.Mount{Type: mount.TypeBind, Source: "/data", Target: "/mnt"}},
+		{spec: "data:/mnt", want: mount.Mount{Type: mount.TypeBind, Source: relative, Target: "/mnt"}},
+		{spec: "/data:/mnt:rshared", want: mount.Mount{Type: mount.TypeBind, Source: "/data", Target: "/mnt", BindOptions: &mount.BindOptions{Propagation: mount.PropagationRShared}}},
+		{spec: "/data", wantErr: true},
+		{spec: "/data:/mnt:rshared:extra", wantErr: true},
+		{spec: "/data:/mnt:shared-ish", wantErr: true},
+	}
+
+	for _, test := range tests {
+		mounts, err := bindMounts([]string{test.spec})
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("expected an error for mount %q", test.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for mount %q: %v", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(mounts, []mount.Mount{test.want}) {
+			t.Errorf("expected %+v for mount %q, got %+v", test.want, test.spec, mounts)
+		}
+	}
+}
+
+func TestDeviceMappings(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    container.DeviceMapping
+		wantErr bool
+	}{
+		{spec: "/dev/kvm", want: container.DeviceMapping{PathOnHost: "/dev/kvm", PathInContainer: "/dev/kvm", CgroupPermissions: "rwm"}},
+		{spec: "/dev/fuse:/dev/fuse0", want: container.DeviceMapping{PathOnHost: "/dev/fuse", PathInContainer: "/dev/fuse0", CgroupPermissions: "rwm"}},
+		{spec: "/dev/net/tun:/dev/net/tun:rw", want: container.DeviceMapping{PathOnHost: "/dev/net/tun", PathInContainer: "/dev/net/tun", CgroupPermissions: "rw"}},
+		{spec: "", wantErr: true},
+		{spec: ":/dev/kvm", wantErr: true},
+		{spec: "/dev/kvm:/dev/kvm:rwm:extra", wantErr: true},
+	}
+
+	for _, test := range tests {
+		mappings, err := deviceMappings([]string{test.spec})
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("expected an error for device %q", test.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for device %q: %v", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(mappings, []container.DeviceMapping{test.want}) {
+			t.Errorf("expected %+v for device %q, got %+v", test.want, test.spec, mappings)
+		}
+	}
+}
+
+func TestCheckPrivilegedConflicts(t *testing.T) {
+	device := []container.DeviceMapping{{PathOnHost: "/dev/fuse", PathInContainer: "/dev/fuse", CgroupPermissions: "rwm"}}
+
+	tests := []struct {
+		name       string
+		privileged bool
+		capAdd     []string
+		capDrop    []string
+		gpuDevices []string
+		devices    []container.DeviceMapping
+		wantErr    string
+	}{
+		{name: "privileged without settings", privileged: true},
+		{name: "unprivileged with all settings", capAdd: []string{"NET_ADMIN"}, capDrop: []string{"MKNOD"}, gpuDevices: []string{"/dev/nvidia0"}, devices: device},
+		{name: "cap-add", privileged: true, capAdd: []string{"NET_ADMIN"}, wantErr: "--cap-add can not be used with privileged nodes, use --privileged=false"},
+		{name: "cap-drop", privileged: true, capDrop: []string{"MKNOD"}, wantErr: "--cap-drop can not be used with privileged nodes, use --privileged=false"},
+		{name: "gpu-device", privileged: true, gpuDevices: []string{"/dev/nvidia0"}, wantErr: "--gpu-device can not be used with privileged nodes, use --privileged=false"},
+		{name: "device", privileged: true, devices: device, wantErr: "--device can not be used with privileged nodes, use --privileged=false"},
+		{
+			name:       "several",
+			privileged: true,
+			capAdd:     []string{"NET_ADMIN"},
+			devices:    device,
+			wantErr:    "--cap-add, --device can not be used with privileged nodes, use --privileged=false",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkPrivilegedConflicts(test.privileged, test.capAdd, test.capDrop, test.gpuDevices, test.devices)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("expected error %q, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestNodePortForwards(t *testing.T) {
+	want := []string{
+		"iptables -t nat -A PREROUTING -p tcp -d 172.18.0.2 -m tcp --dport 2201 -j DNAT --to-destination 192.168.66.101:22",
+		"iptables -t nat -A PREROUTING -p tcp -d 172.18.0.2 -m tcp --dport 2202 -j DNAT --to-destination 192.168.66.102:22",
+		"iptables -t nat -A PREROUTING -p tcp -d 172.18.0.2 -m tcp --dport 6443 -j DNAT --to-destination 192.168.66.101:6443",
+		"iptables -t nat -A PREROUTING -p tcp -d 172.18.0.2 -m tcp --dport 8443 -j DNAT --to-destination 192.168.66.101:8443",
+	}
+	if got := nodePortForwards("172.18.0.2", 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,67 @@
+package docker
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+var (
+	auditLock sync.Mutex
+	auditLog  io.Writer
+)
+
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Container string    `json:"container"`
+	Args      []string  `json:"args"`
+	User      string    `json:"user"`
+	// ExitCode is not set for background commands when they are started
+	ExitCode   *int   `json:"exitCode,omitempty"`
+	Background bool   `json:"background,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// SetExecAuditLog makes all exec helpers write a JSON line with time, container, command, local
+// user and exit code for every command they ran to writer. Background commands are logged when
+// they are started, since they may never be waited for, and again with their exit code on Wait.
+// A nil writer disables the audit log.
+func SetExecAuditLog(writer io.Writer) {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	auditLog = writer
+}
+
+func auditExec(container string, args []string, exitCode int, err error) {
+	writeAuditRecord(auditRecord{Container: container, Args: args, ExitCode: &exitCode}, err)
+}
+
+func auditBackgroundExec(container string, args []string, err error) {
+	writeAuditRecord(auditRecord{Container: container, Args: args, Background: true}, err)
+}
+
+func writeAuditRecord(record auditRecord, err error) {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	if auditLog == nil {
+		return
+	}
+
+	record.Time = time.Now().UTC()
+	record.User = os.Getenv("USER")
+	if u, userErr := user.Current(); userErr == nil {
+		record.User = u.Username
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	line, marshalErr := json.Marshal(record)
+	if marshalErr != nil {
+		return
+	}
+	auditLog.Write(append(line, '\n'))
+}
@@ -0,0 +1,290 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var moduleName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// CheckKernelModules reports for every module whether it is loaded in the node VM behind the container,
+// based on /sys/module. The container itself shares the host kernel, which is not the one the cluster runs on.
+func CheckKernelModules(ctx context.Context, cli *client.Client, container string, modules []string) (map[string]bool, error) {
+	for _, m := range modules {
+		if !moduleName.MatchString(m) {
+			return nil, fmt.Errorf("invalid kernel module name %q", m)
+		}
+	}
+	// The kernel lists modules with underscores, even if they are loaded by a name with dashes
+	script := fmt.Sprintf(`for m in %s; do if [ -d "/sys/module/${m//-/_}" ]; then echo "$m"; fi; done`, strings.Join(modules, " "))
+
+	var stdout, stderr bytes.Buffer
+	exitCode, err := execAttached(ctx, cli, container, []string{"/bin/bash", "-c", `echo "$0" | ssh.sh /bin/bash`, script}, false, &stdout, &stderr)
+	if err != nil {
+		return nil, err
+	}
+	if exitCode != 0 {
+		return nil, fmt.Errorf("checking kernel modules in the node of container %s failed: %s", container, stderr.String())
+	}
+
+	loaded := map[string]bool{}
+	for _, m := range modules {
+		loaded[m] = false
+	}
+	for _, m := range strings.Fields(stdout.String()) {
+		loaded[m] = true
+	}
+	return loaded, nil
+}
+
+var knownShells = []string{"bash", "sh", "ash", "zsh"}
+
+// DetectShells returns the well known shells which are available in the container.
+func DetectShells(ctx context.Context, cli *client.Client, container string) ([]string, error) {
+	shells := []string{}
+	for _, shell := range knownShells {
+		// Not every image has bash, so the lookup is done through each shell itself
+		exitCode, err := execAttached(ctx, cli, container, []string{shell, "-c", "command -v " + shell}, false, ioutil.Discard, ioutil.Discard)
+		if err != nil {
+			// Docker fails to create the exec if the executable does not exist
+			if strings.Contains(err.Error(), "executable file not found") || strings.Contains(err.Error(), "no such file or directory") {
+				continue
+			}
+			return nil, err
+		}
+		if exitCode == 0 {
+			shells = append(shells, shell)
+		}
+	}
+	return shells, nil
+}
+
+// CheckClockSkew returns an error if the clock of the node VM behind the container differs from the host
+// clock by more than maxSkew. The container shares the host clock, the VM keeps its own.
+func CheckClockSkew(ctx context.Context, cli *client.Client, container string, maxSkew time.Duration) error {
+	var stdout, stderr bytes.Buffer
+	before := time.Now()
+	exitCode, err := execAttached(ctx, cli, container, []string{"ssh.sh", "date", "+%s"}, false, &stdout, &stderr)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("reading the clock of the node of container %s failed: %s", container, stderr.String())
+	}
+	// The node clock was read somewhere during the exec roundtrip
+	host := before.Add(time.Since(before) / 2)
+
+	seconds, err := strconv.ParseInt(strings.TrimSpace(stdout.String()), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid date output %q from container %s: %v", stdout.String(), container, err)
+	}
+
+	skew := time.Unix(seconds, 0).Sub(host)
+	if skew < 0 {
+		skew = -skew
+	}
+	// date only has a resolution of one second
+	if skew > maxSkew+time.Second {
+		return fmt.Errorf("clock of the node of container %s is off by %v, more than the allowed %v", container, skew, maxSkew)
+	}
+	return nil
+}
+
+// CheckTimezone returns an error if the time zone of the node VM behind the container is not expected.
+// The time zone is read from /etc/timezone or the /etc/localtime link, or from the date abbreviation
+// on VMs without either. Names are compared without the zoneinfo directory and the Etc/ prefix, so that
+// UTC and Etc/UTC match.
+func CheckTimezone(ctx context.Context, cli *client.Client, container string, expected string) error {
+	script := "if [ -f /etc/timezone ]; then cat /etc/timezone; elif [ -L /etc/localtime ]; then readlink /etc/localtime; else date +%Z; fi"
+
+	var stdout, stderr bytes.Buffer
+	exitCode, err := execAttached(ctx, cli, container, []string{"/bin/bash", "-c", `echo "$0" | ssh.sh /bin/bash`, script}, false, &stdout, &stderr)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("reading the time zone of the node of container %s failed: %s", container, stderr.String())
+	}
+
+	timezone := normalizeTimezone(stdout.String())
+	if timezone != normalizeTimezone(expected) {
+		return fmt.Errorf("node of container %s uses time zone %s, expected %s", container, timezone, expected)
+	}
+	return nil
+}
+
+// shellQuote quotes value for scripts which run in the node VM
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+func normalizeTimezone(timezone string) string {
+	timezone = strings.TrimSpace(timezone)
+	if i := strings.Index(timezone, "zoneinfo/"); i >= 0 {
+		timezone = timezone[i+len("zoneinfo/"):]
+	}
+	return strings.TrimPrefix(timezone, "Etc/")
+}
+
+// GetNodeDiskUsage returns the used and total bytes of the filesystem containing path in the node VM
+// behind the container. The container filesystem is not the one the cluster fills up.
+func GetNodeDiskUsage(ctx context.Context, cli *client.Client, container string, path string) (used int64, total int64, err error) {
+	script := "df -P -k " + shellQuote(path)
+
+	var stdout, stderr bytes.Buffer
+	exitCode, err := execAttached(ctx, cli, container, []string{"/bin/bash", "-c", `echo "$0" | ssh.sh /bin/bash`, script}, false, &stdout, &stderr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if exitCode != 0 {
+		return 0, 0, fmt.Errorf("checking disk usage of %s in the node of container %s failed: %s", path, container, stderr.String())
+	}
+
+	// Filesystem 1024-blocks Used Available Capacity Mounted on
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(lines) < 2 || len(fields) < 3 {
+		return 0, 0, fmt.Errorf("unexpected df output from container %s: %s", container, stdout.String())
+	}
+	total, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unexpected df output from container %s: %s", container, stdout.String())
+	}
+	used, err = strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unexpected df output from container %s: %s", container, stdout.String())
+	}
+	return used * 1024, total * 1024, nil
+}
+
+// CheckPortRangeAvailable returns all ports in [startPort, startPort+count) which can't be bound on the host.
+func CheckPortRangeAvailable(startPort int, count int) (conflicts []int, err error) {
+	if startPort < 1 || count < 0 || startPort+count-1 > 65535 {
+		return nil, fmt.Errorf("invalid port range %d-%d", startPort, startPort+count-1)
+	}
+
+	conflicts = []int{}
+	for port := startPort; port < startPort+count; port++ {
+		listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err != nil {
+			conflicts = append(conflicts, port)
+			continue
+		}
+		listener.Close()
+	}
+	return conflicts, nil
+}
+
+// GetCgroupVersion returns the cgroup version of the docker host. The vendored API predates the
+// CgroupVersion field of the daemon info, so it is detected from the cgroup filesystem of the
+// local host, which only matches the daemon when docker runs locally.
+func GetCgroupVersion(ctx context.Context, cli *client.Client) (int, error) {
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if info.OSType != "linux" {
+		return 0, fmt.Errorf("docker daemon runs on %s, cgroups are only available on linux", info.OSType)
+	}
+
+	// Only the unified cgroup v2 hierarchy has this file in its root
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err == nil {
+		return 2, nil
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// CheckOutboundConnectivity returns an error if the node VM behind the container can't reach testHost,
+// like quay.io. curl is used when the VM has it, ping otherwise.
+func CheckOutboundConnectivity(ctx context.Context, cli *client.Client, container string, testHost string) error {
+	script := fmt.Sprintf(`host=%s; if command -v curl > /dev/null; then curl -sS -o /dev/null --connect-timeout 10 "$host"; else ping -c 1 -W 10 "$host" > /dev/null; fi`, shellQuote(testHost))
+
+	var stderr bytes.Buffer
+	exitCode, err := execAttached(ctx, cli, container, []string{"/bin/bash", "-c", `echo "$0" | ssh.sh /bin/bash`, script}, false, ioutil.Discard, &stderr)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("node %s has no internet access, reaching %s failed: %s", container, testHost, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// CheckPortReachable returns an error if port on host does not accept connections from a container on
+// the given network. The check runs in a throwaway container of image, which needs bash and timeout,
+// like the cluster images.
+func CheckPortReachable(ctx context.Context, cli *client.Client, image string, networkName string, host string, port int) error {
+	created, err := cli.ContainerCreate(ctx, &container.Config{
+		Image: image,
+		Cmd:   []string{"timeout", "10", "/bin/bash", "-c", `exec 3<> "/dev/tcp/$0/$1"`, host, strconv.Itoa(port)},
+	}, &container.HostConfig{
+		NetworkMode: container.NetworkMode(networkName),
+	}, nil, "")
+	if err != nil {
+		return err
+	}
+	defer cli.ContainerRemove(context.Background(), created.ID, types.ContainerRemoveOptions{Force: true})
+
+	if err := cli.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+		return err
+	}
+	exitCode, err := cli.ContainerWait(ctx, created.ID)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("port %d of %s is not reachable on network %s", port, host, networkName)
+	}
+	return nil
+}
+
+// CheckDefaultBridge returns the names of cluster containers attached to the default bridge network.
+// Only dnsmasq is expected there, all other cluster containers join its network namespace and
+// resolve node and service names through it. A container on the bridge with its own namespace
+// can't resolve them.
+func CheckDefaultBridge(ctx context.Context, cli *client.Client, prefix string) ([]string, error) {
+	dnsmasq, err := GetDDNSMasqContainer(cli, prefix)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := GetPrefixedContainers(cli, prefix+"-")
+	if err != nil {
+		return nil, err
+	}
+
+	misconfigured := []string{}
+	for _, c := range containers {
+		name := NodeName(prefix, c)
+		if name == "" || c.ID == dnsmasq.ID {
+			continue
+		}
+		details, err := cli.ContainerInspect(ctx, c.ID)
+		if err != nil {
+			return nil, err
+		}
+		if details.HostConfig.NetworkMode.IsContainer() {
+			continue
+		}
+		if details.NetworkSettings != nil {
+			if _, onBridge := details.NetworkSettings.Networks["bridge"]; onBridge {
+				misconfigured = append(misconfigured, name)
+			}
+		}
+	}
+	sort.Strings(misconfigured)
+	return misconfigured, nil
+}
@@ -0,0 +1,24 @@
+package docker
+
+import (
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"/var/lib/docker", "'/var/lib/docker'"},
+		{"/mnt/my disk", "'/mnt/my disk'"},
+		{"$(reboot)", "'$(reboot)'"},
+		{"it's", `'it'\''s'`},
+		{"", "''"},
+	}
+
+	for _, test := range tests {
+		if got := shellQuote(test.value); got != test.want {
+			t.Errorf("shellQuote(%q): expected %s, got %s", test.value, test.want, got)
+		}
+	}
+}
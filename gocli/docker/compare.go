@@ -0,0 +1,139 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"strings"
+)
+
+// envPerNode are variables which are expected to differ between nodes
+var envPerNode = map[string]bool{
+	"NODE_NUM": true,
+	"HOSTNAME": true,
+}
+
+type ValueDiff struct {
+	A string
+	B string
+}
+
+// NodeDiff holds the settings which differ between two node containers. Values
+// which are not set on a node are empty. Node specific values, like the node number
+// or the disk volume of the node, are not reported.
+type NodeDiff struct {
+	NodeA string
+	NodeB string
+	// Env is keyed by variable name
+	Env map[string]ValueDiff
+	// Mounts is keyed by mount destination
+	Mounts map[string]ValueDiff
+	// Resources is keyed by the name of the host config setting, like Memory
+	Resources map[string]ValueDiff
+	// Image is set if the nodes run different images
+	Image *ValueDiff
+}
+
+// HasDifferences returns whether the nodes differ in any compared setting.
+func (d NodeDiff) HasDifferences() bool {
+	return len(d.Env) > 0 || len(d.Mounts) > 0 || len(d.Resources) > 0 || d.Image != nil
+}
+
+// CompareNodes diffs the environment, mounts, resource limits and images of two node containers of the cluster.
+func CompareNodes(ctx context.Context, cli *client.Client, prefix string, nodeA int, nodeB int) (NodeDiff, error) {
+	diff := NodeDiff{
+		NodeA:     fmt.Sprintf("node%02d", nodeA),
+		NodeB:     fmt.Sprintf("node%02d", nodeB),
+		Env:       map[string]ValueDiff{},
+		Mounts:    map[string]ValueDiff{},
+		Resources: map[string]ValueDiff{},
+	}
+
+	a, err := cli.ContainerInspect(ctx, prefix+"-"+diff.NodeA)
+	if err != nil {
+		return diff, err
+	}
+	b, err := cli.ContainerInspect(ctx, prefix+"-"+diff.NodeB)
+	if err != nil {
+		return diff, err
+	}
+
+	addDiffs(diff.Env, nodeEnv(a), nodeEnv(b))
+	addDiffs(diff.Mounts, nodeMounts(a, diff.NodeA), nodeMounts(b, diff.NodeB))
+	addDiffs(diff.Resources, nodeResources(a), nodeResources(b))
+
+	imageA := a.Config.Image + "@" + a.Image
+	imageB := b.Config.Image + "@" + b.Image
+	if imageA != imageB {
+		diff.Image = &ValueDiff{A: imageA, B: imageB}
+	}
+	return diff, nil
+}
+
+func addDiffs(diffs map[string]ValueDiff, a map[string]string, b map[string]string) {
+	for key, value := range a {
+		if b[key] != value {
+			diffs[key] = ValueDiff{A: value, B: b[key]}
+		}
+	}
+	for key, value := range b {
+		if _, exists := a[key]; !exists {
+			diffs[key] = ValueDiff{B: value}
+		}
+	}
+}
+
+func nodeEnv(details types.ContainerJSON) map[string]string {
+	env := map[string]string{}
+	for _, variable := range details.Config.Env {
+		parts := strings.SplitN(variable, "=", 2)
+		if envPerNode[parts[0]] {
+			continue
+		}
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		} else {
+			env[parts[0]] = ""
+		}
+	}
+	return env
+}
+
+// nodeMounts describes the mounts by destination, with the node name in sources replaced, so that
+// the per node disk volumes compare equal
+func nodeMounts(details types.ContainerJSON, nodeName string) map[string]string {
+	mounts := map[string]string{}
+	for _, m := range details.Mounts {
+		source := m.Source
+		if m.Name != "" {
+			source = m.Name
+		}
+		source = strings.Replace(source, nodeName, "<node>", -1)
+		mounts[m.Destination] = fmt.Sprintf("%s %s rw=%v %s", m.Type, source, m.RW, m.Propagation)
+	}
+	return mounts
+}
+
+func nodeResources(details types.ContainerJSON) map[string]string {
+	hostConfig := details.HostConfig
+	devices := []string{}
+	for _, d := range hostConfig.Devices {
+		devices = append(devices, fmt.Sprintf("%s:%s:%s", d.PathOnHost, d.PathInContainer, d.CgroupPermissions))
+	}
+	return map[string]string{
+		"Memory":       fmt.Sprint(hostConfig.Memory),
+		"MemorySwap":   fmt.Sprint(hostConfig.MemorySwap),
+		"NanoCPUs":     fmt.Sprint(hostConfig.NanoCPUs),
+		"CPUShares":    fmt.Sprint(hostConfig.CPUShares),
+		"CpusetCpus":   hostConfig.CpusetCpus,
+		"PidsLimit":    fmt.Sprint(hostConfig.PidsLimit),
+		"ShmSize":      fmt.Sprint(hostConfig.ShmSize),
+		"OomScoreAdj":  fmt.Sprint(hostConfig.OomScoreAdj),
+		"CgroupParent": hostConfig.CgroupParent,
+		"Devices":      strings.Join(devices, ","),
+		"Privileged":   fmt.Sprint(hostConfig.Privileged),
+		"CapAdd":       strings.Join(hostConfig.CapAdd, ","),
+		"CapDrop":      strings.Join(hostConfig.CapDrop, ","),
+	}
+}
@@ -0,0 +1,63 @@
+package docker
+
+import (
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"reflect"
+	"testing"
+)
+
+func TestAddDiffs(t *testing.T) {
+	tests := []struct {
+		name string
+		a    map[string]string
+		b    map[string]string
+		want map[string]ValueDiff
+	}{
+		{"equal", map[string]string{"A": "1"}, map[string]string{"A": "1"}, map[string]ValueDiff{}},
+		{"changed", map[string]string{"A": "1"}, map[string]string{"A": "2"}, map[string]ValueDiff{"A": {A: "1", B: "2"}}},
+		{"only in a", map[string]string{"A": "1"}, map[string]string{}, map[string]ValueDiff{"A": {A: "1"}}},
+		{"only in b", map[string]string{}, map[string]string{"B": "2"}, map[string]ValueDiff{"B": {B: "2"}}},
+		{"empty value only in b", map[string]string{}, map[string]string{"B": ""}, map[string]ValueDiff{"B": {}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diffs := map[string]ValueDiff{}
+			addDiffs(diffs, test.a, test.b)
+			if !reflect.DeepEqual(diffs, test.want) {
+				t.Errorf("expected %v, got %v", test.want, diffs)
+			}
+		})
+	}
+}
+
+func TestNodeEnv(t *testing.T) {
+	details := types.ContainerJSON{Config: &container.Config{Env: []string{"NODE_NUM=2", "HOSTNAME=node02", "A=1", "B=x=y", "EMPTY"}}}
+	want := map[string]string{"A": "1", "B": "x=y", "EMPTY": ""}
+	if env := nodeEnv(details); !reflect.DeepEqual(env, want) {
+		t.Errorf("expected %v, got %v", want, env)
+	}
+}
+
+func TestNodeMounts(t *testing.T) {
+	mountsOf := func(node string) types.ContainerJSON {
+		return types.ContainerJSON{Mounts: []types.MountPoint{
+			{Type: "volume", Name: "k8s-" + node, Source: "/var/lib/docker/volumes/k8s-" + node + "/_data", Destination: "/var/run/disk", RW: true},
+			{Type: "bind", Source: "/data", Destination: "/data", Propagation: "rshared"},
+		}}
+	}
+
+	a := nodeMounts(mountsOf("node01"), "node01")
+	b := nodeMounts(mountsOf("node02"), "node02")
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("expected the node volumes to compare equal, got %v and %v", a, b)
+	}
+	want := map[string]string{
+		"/var/run/disk": "volume k8s-<node> rw=true ",
+		"/data":         "bind /data rw=false rshared",
+	}
+	if !reflect.DeepEqual(a, want) {
+		t.Errorf("expected %v, got %v", want, a)
+	}
+}
@@ -0,0 +1,112 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/docker/docker/client"
+	"strings"
+	"sync"
+)
+
+// ReloadDNS is like DNSMasqResolver.ReloadDNS, but looks the dnsmasq container up on every call.
+//
+// Deprecated: use a DNSMasqResolver, which looks it up once for all changes.
+func ReloadDNS(ctx context.Context, cli *client.Client, prefix string) error {
+	return NewDNSMasqResolver(cli).ReloadDNS(ctx, prefix)
+}
+
+// AddDNSEntry is like DNSMasqResolver.AddDNSEntry, but looks the dnsmasq container up on every call.
+//
+// Deprecated: use a DNSMasqResolver, which looks it up once for all changes.
+func AddDNSEntry(ctx context.Context, cli *client.Client, prefix string, hostname string, ip string) error {
+	return NewDNSMasqResolver(cli).AddDNSEntry(ctx, prefix, hostname, ip)
+}
+
+// DNSMasqResolver remembers the dnsmasq container of every prefix, so that multi step
+// commands don't list all containers each time they need it.
+type DNSMasqResolver struct {
+	cli  *client.Client
+	lock sync.Mutex
+	ids  map[string]string
+}
+
+func NewDNSMasqResolver(cli *client.Client) *DNSMasqResolver {
+	return &DNSMasqResolver{cli: cli, ids: map[string]string{}}
+}
+
+// ContainerID returns the ID of the dnsmasq container of the cluster.
+func (r *DNSMasqResolver) ContainerID(prefix string) (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if id, exists := r.ids[prefix]; exists {
+		return id, nil
+	}
+	dnsmasq, err := GetDDNSMasqContainer(r.cli, prefix)
+	if err != nil {
+		return "", err
+	}
+	r.ids[prefix] = dnsmasq.ID
+	return dnsmasq.ID, nil
+}
+
+// Invalidate forgets the dnsmasq container of the cluster.
+func (r *DNSMasqResolver) Invalidate(prefix string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.ids, prefix)
+}
+
+// Do calls f with the dnsmasq container ID. If the remembered container does not exist
+// anymore, for example because the cluster was recreated, it is looked up again and f is
+// called once more.
+func (r *DNSMasqResolver) Do(prefix string, f func(id string) error) error {
+	id, err := r.ContainerID(prefix)
+	if err != nil {
+		return err
+	}
+	err = f(id)
+	if err == nil || !isNoSuchContainer(err) {
+		return err
+	}
+
+	r.Invalidate(prefix)
+	id, err = r.ContainerID(prefix)
+	if err != nil {
+		return err
+	}
+	return f(id)
+}
+
+// ReloadDNS makes dnsmasq re-read its hosts files without restarting the
+// container. dnsmasq runs as PID 1 in the dnsmasq container, so signalling the
+// container delivers the SIGHUP directly to it.
+func (r *DNSMasqResolver) ReloadDNS(ctx context.Context, prefix string) error {
+	return r.Do(prefix, func(id string) error {
+		return r.cli.ContainerKill(ctx, id, "SIGHUP")
+	})
+}
+
+// AddDNSEntry publishes hostname with the given ip to the cluster DNS. Like
+// the nfs and registry entries, it is served from the hosts file of the
+// dnsmasq container.
+func (r *DNSMasqResolver) AddDNSEntry(ctx context.Context, prefix string, hostname string, ip string) error {
+	return r.Do(prefix, func(id string) error {
+		var out bytes.Buffer
+		exitCode, err := execWithExitCode(ctx, r.cli, id, []string{"/bin/bash", "-c", `echo "$0 $1" >> /etc/hosts`, ip, hostname}, &out)
+		if err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			return fmt.Errorf("adding dns entry %s for %s failed: %s", hostname, ip, out.String())
+		}
+		return r.cli.ContainerKill(ctx, id, "SIGHUP")
+	})
+}
+
+// isNoSuchContainer recognizes missing containers by the daemon message, since most
+// of the client calls don't return typed errors for them
+func isNoSuchContainer(err error) bool {
+	return client.IsErrNotFound(err) || strings.Contains(err.Error(), "No such container") || strings.Contains(err.Error(), "no container with name or ID")
+}
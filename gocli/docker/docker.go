@@ -2,19 +2,98 @@ package docker
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
 	"golang.org/x/crypto/ssh/terminal"
 	"io"
 	"os"
 	"os/signal"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 )
 
+const (
+	// LABEL_CLUSTER is set on docker resources which belong to a kubevirtci cluster, its value is the cluster prefix
+	LABEL_CLUSTER = "io.kubevirtci.cluster"
+	// LABEL_OWNER is set to the tool which created a docker resource
+	LABEL_OWNER = "io.kubevirtci.owner"
+
+	OWNER_GOCLI = "gocli"
+)
+
+var nodeNamePattern = regexp.MustCompile(`^node[0-9]+$`)
+
+type SelectionMode int
+
+const (
+	// ByName selects cluster resources whose name contains the prefix
+	ByName SelectionMode = iota
+	// ByLabel selects cluster resources by their cluster label, so that clusters
+	// whose prefixes contain each other don't collide. Unlabelled resources of
+	// older clusters are not found in this mode.
+	ByLabel
+)
+
+var selectionMode = ByName
+
+// SetSelectionMode switches how GetPrefixedContainers, GetPrefixedVolumes and the helpers
+// based on them select cluster resources. It is meant to be called once at startup.
+func SetSelectionMode(mode SelectionMode) {
+	selectionMode = mode
+}
+
+// ClusterLabels returns the labels of docker resources which belong to the cluster.
+func ClusterLabels(prefix string) map[string]string {
+	return map[string]string{
+		LABEL_CLUSTER: prefix,
+		LABEL_OWNER:   OWNER_GOCLI,
+	}
+}
+
+// selectedByLabel returns whether a resource with the given names and labels is selected by
+// the name prefix, like kubevirt-node, in ByLabel mode. The prefix has to be within the
+// namespace of the cluster the resource is labelled with.
+func selectedByLabel(prefix string, names []string, labels map[string]string) bool {
+	cluster, exists := labels[LABEL_CLUSTER]
+	if !exists || !strings.HasPrefix(prefix, cluster+"-") {
+		return false
+	}
+	for _, name := range names {
+		if strings.HasPrefix(strings.TrimPrefix(name, "/"), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 func GetPrefixedContainers(cli *client.Client, prefix string) ([]types.Container, error) {
+	if selectionMode == ByLabel {
+		args := filters.NewArgs()
+		args.Add("label", LABEL_CLUSTER)
+		containers, err := cli.ContainerList(context.Background(), types.ContainerListOptions{
+			Filters: args,
+			All:     true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		selected := []types.Container{}
+		for _, c := range containers {
+			if selectedByLabel(prefix, c.Names, c.Labels) {
+				selected = append(selected, c)
+			}
+		}
+		return selected, nil
+	}
+
 	args, err := filters.ParseFlag("name="+prefix, filters.NewArgs())
 	if err != nil {
 		return nil, err
@@ -26,7 +105,97 @@ func GetPrefixedContainers(cli *client.Client, prefix string) ([]types.Container
 	return containers, err
 }
 
+// GetNodeContainers returns the node containers of the cluster, ordered by node number.
+func GetNodeContainers(cli *client.Client, prefix string) ([]types.Container, error) {
+	containers, err := GetPrefixedContainers(cli, prefix+"-node")
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []types.Container{}
+	for _, c := range containers {
+		if nodeNamePattern.MatchString(NodeName(prefix, c)) {
+			nodes = append(nodes, c)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return NodeName(prefix, nodes[i]) < NodeName(prefix, nodes[j])
+	})
+	return nodes, nil
+}
+
+// NodeName returns the node name of a cluster container, like node01.
+func NodeName(prefix string, c types.Container) string {
+	for _, name := range c.Names {
+		if strings.HasPrefix(name, "/"+prefix+"-") {
+			return strings.TrimPrefix(name, "/"+prefix+"-")
+		}
+	}
+	return ""
+}
+
+// ListClusterPrefixes returns the sorted prefixes of all clusters, based on their dnsmasq containers.
+func ListClusterPrefixes(cli *client.Client) ([]string, error) {
+	args, err := filters.ParseFlag("name=-dnsmasq", filters.NewArgs())
+	if err != nil {
+		return nil, err
+	}
+	containers, err := cli.ContainerList(context.Background(), types.ContainerListOptions{
+		Filters: args,
+		All:     true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	prefixes := []string{}
+	for _, c := range containers {
+		for _, name := range c.Names {
+			if !strings.HasSuffix(name, "-dnsmasq") {
+				continue
+			}
+			prefix := strings.TrimSuffix(strings.TrimPrefix(name, "/"), "-dnsmasq")
+			if selectionMode == ByLabel && c.Labels[LABEL_CLUSTER] != prefix {
+				continue
+			}
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes, nil
+}
+
+// WriteClusterPrefixes writes the cluster prefixes one per line, for use in completion scripts.
+func WriteClusterPrefixes(cli *client.Client, writer io.Writer) error {
+	prefixes, err := ListClusterPrefixes(cli)
+	if err != nil {
+		return err
+	}
+	for _, prefix := range prefixes {
+		if _, err := fmt.Fprintln(writer, prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func GetPrefixedVolumes(cli *client.Client, prefix string) ([]*types.Volume, error) {
+	if selectionMode == ByLabel {
+		args := filters.NewArgs()
+		args.Add("label", LABEL_CLUSTER)
+		volumes, err := cli.VolumeList(context.Background(), args)
+		if err != nil {
+			return nil, err
+		}
+		selected := []*types.Volume{}
+		for _, v := range volumes.Volumes {
+			if selectedByLabel(prefix, []string{v.Name}, v.Labels) {
+				selected = append(selected, v)
+			}
+		}
+		return selected, nil
+	}
+
 	args, err := filters.ParseFlag("name="+prefix, filters.NewArgs())
 	if err != nil {
 		return nil, err
@@ -38,6 +207,52 @@ func GetPrefixedVolumes(cli *client.Client, prefix string) ([]*types.Volume, err
 	return volumes.Volumes, nil
 }
 
+// CreateVolume creates the volume <prefix>-<name> and labels it as part of the cluster.
+func CreateVolume(ctx context.Context, cli *client.Client, prefix string, name string) (types.Volume, error) {
+	return cli.VolumeCreate(ctx, volume.VolumesCreateBody{
+		Name:   fmt.Sprintf("%s-%s", prefix, name),
+		Labels: ClusterLabels(prefix),
+	})
+}
+
+// GetVolumesByLabels returns all volumes which have all the given labels.
+func GetVolumesByLabels(ctx context.Context, cli *client.Client, labels map[string]string) ([]*types.Volume, error) {
+	args := filters.NewArgs()
+	for key, value := range labels {
+		args.Add("label", key+"="+value)
+	}
+	volumes, err := cli.VolumeList(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return volumes.Volumes, nil
+}
+
+// GetOrphanedNetworks returns all kubevirtci networks which have no containers attached anymore.
+func GetOrphanedNetworks(ctx context.Context, cli *client.Client) ([]types.NetworkResource, error) {
+	args, err := filters.ParseFlag("label="+LABEL_CLUSTER, filters.NewArgs())
+	if err != nil {
+		return nil, err
+	}
+	networks, err := cli.NetworkList(ctx, types.NetworkListOptions{Filters: args})
+	if err != nil {
+		return nil, err
+	}
+
+	orphaned := []types.NetworkResource{}
+	for _, n := range networks {
+		// The network list does not reliably contain the attached containers
+		network, err := cli.NetworkInspect(ctx, n.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(network.Containers) == 0 {
+			orphaned = append(orphaned, network)
+		}
+	}
+	return orphaned, nil
+}
+
 func GetDDNSMasqContainer(cli *client.Client, prefix string) (*types.Container, error) {
 	containers, err := GetPrefixedContainers(cli, prefix+"-"+"dnsmasq")
 	if err != nil {
@@ -51,11 +266,148 @@ func GetDDNSMasqContainer(cli *client.Client, prefix string) (*types.Container,
 	return nil, fmt.Errorf("Could not identify dnsmasq container %s", prefix+"-dnsmasq")
 }
 
+func GetRestartCount(ctx context.Context, cli *client.Client, container string) (int, error) {
+	c, err := cli.ContainerInspect(ctx, container)
+	if err != nil {
+		return 0, err
+	}
+	return c.RestartCount, nil
+}
+
+func GetContainerLabels(ctx context.Context, cli *client.Client, container string) (map[string]string, error) {
+	c, err := cli.ContainerInspect(ctx, container)
+	if err != nil {
+		return nil, err
+	}
+	if c.Config == nil || c.Config.Labels == nil {
+		return map[string]string{}, nil
+	}
+	return c.Config.Labels, nil
+}
+
+// InspectRaw returns the inspect JSON of the container as it is returned by the docker API.
+func InspectRaw(ctx context.Context, cli *client.Client, container string) ([]byte, error) {
+	_, raw, err := cli.ContainerInspectWithRaw(ctx, container, false)
+	if err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+func UsesHostNetwork(ctx context.Context, cli *client.Client, container string) (bool, error) {
+	c, err := cli.ContainerInspect(ctx, container)
+	if err != nil {
+		return false, err
+	}
+	return c.HostConfig.NetworkMode.IsHost(), nil
+}
+
 func Exec(cli *client.Client, container string, args []string, out io.Writer) (bool, error) {
-	ctx := context.Background()
-	id, err := cli.ContainerExecCreate(ctx, container, types.ExecConfig{
+	return ExecWithContext(context.Background(), cli, container, args, out)
+}
+
+// ExecWithContext is like Exec, but aborts the command once the context is cancelled or its deadline is exceeded.
+func ExecWithContext(ctx context.Context, cli *client.Client, container string, args []string, out io.Writer) (bool, error) {
+	exitCode, err := execWithExitCode(ctx, cli, container, args, out)
+	if err != nil {
+		return false, err
+	}
+	return exitCode == 0, nil
+}
+
+// ExecExpectExit runs the command and returns an error containing the
+// command output if it does not exit with the expected exit code.
+func ExecExpectExit(cli *client.Client, container string, args []string, expected int) error {
+	var out bytes.Buffer
+	exitCode, err := execWithExitCode(context.Background(), cli, container, args, &out)
+	if err != nil {
+		return err
+	}
+	if exitCode != expected {
+		return fmt.Errorf("command %v in container %s exited with %d, expected %d: %s", args, container, exitCode, expected, out.String())
+	}
+	return nil
+}
+
+func execWithExitCode(ctx context.Context, cli *client.Client, container string, args []string, out io.Writer) (int, error) {
+	return execAttached(ctx, cli, container, args, true, out, out)
+}
+
+// ResolveContainer returns the ID of the container whose name or ID is reference, or whose ID starts
+// with reference, like the short IDs from docker ps. It fails if several container IDs have that prefix.
+func ResolveContainer(ctx context.Context, cli *client.Client, reference string) (string, error) {
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return "", err
+	}
+
+	matches := []string{}
+	for _, c := range containers {
+		if c.ID == reference {
+			return c.ID, nil
+		}
+		for _, name := range c.Names {
+			if name == "/"+reference {
+				return c.ID, nil
+			}
+		}
+		if strings.HasPrefix(c.ID, reference) {
+			matches = append(matches, c.ID)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no container with name or ID %s found", reference)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("container ID prefix %s is ambiguous, it matches %s", reference, strings.Join(matches, ", "))
+	}
+}
+
+// ErrContainerNotRunning is returned by the exec helpers for containers which are not running.
+type ErrContainerNotRunning struct {
+	Container string
+	// State is the docker state of the container, like exited or restarting
+	State string
+}
+
+func (e ErrContainerNotRunning) Error() string {
+	return fmt.Sprintf("container %s is not running, it is %s", e.Container, e.State)
+}
+
+// execCreate creates the exec after checking that the container is running, resolving
+// the container with ResolveContainer if docker can't find it directly.
+func execCreate(ctx context.Context, cli *client.Client, container string, config types.ExecConfig) (types.IDResponse, error) {
+	details, err := cli.ContainerInspect(ctx, container)
+	if err != nil && (client.IsErrNotFound(err) || strings.Contains(err.Error(), "multiple IDs found")) {
+		resolved, resolveErr := ResolveContainer(ctx, cli, container)
+		if resolveErr != nil {
+			return types.IDResponse{}, resolveErr
+		}
+		details, err = cli.ContainerInspect(ctx, resolved)
+	}
+	if err != nil {
+		return types.IDResponse{}, err
+	}
+
+	if !details.State.Running || details.State.Paused || details.State.Restarting {
+		return types.IDResponse{}, ErrContainerNotRunning{Container: container, State: details.State.Status}
+	}
+	return cli.ContainerExecCreate(ctx, details.ID, config)
+}
+
+// execAttached runs the command and copies its output to stdout and stderr. Without a tty
+// docker multiplexes both streams into one connection, which gets split up again here.
+func execAttached(ctx context.Context, cli *client.Client, container string, args []string, tty bool, stdout io.Writer, stderr io.Writer) (exitCode int, err error) {
+	defer func() {
+		auditExec(container, args, exitCode, err)
+	}()
+
+	id, err := execCreate(ctx, cli, container, types.ExecConfig{
 		Privileged:   true,
-		Tty:          true,
+		Tty:          tty,
 		Detach:       false,
 		Cmd:          args,
 		AttachStdout: true,
@@ -63,32 +415,82 @@ func Exec(cli *client.Client, container string, args []string, out io.Writer) (b
 	})
 
 	if err != nil {
-		return false, err
+		return -1, err
 	}
 
 	attached, err := cli.ContainerExecAttach(ctx, id.ID, types.ExecConfig{
 		AttachStderr: true,
 		AttachStdout: true,
-		Tty:          true,
+		Tty:          tty,
 	})
 	if err != nil {
-		return false, err
+		return -1, err
 	}
 	defer attached.Close()
 
-	io.Copy(out, attached.Reader)
+	// Reading from the hijacked connection ignores the context, so it gets
+	// closed to abort the copy once the deadline is reached
+	copied := make(chan struct{})
+	defer close(copied)
+	go func() {
+		select {
+		case <-ctx.Done():
+			attached.Close()
+		case <-copied:
+		}
+	}()
+
+	if tty {
+		io.Copy(stdout, attached.Reader)
+	} else if err := demultiplex(stdout, stderr, attached.Reader); err != nil && ctx.Err() == nil {
+		return -1, err
+	}
+	if ctx.Err() != nil {
+		return -1, ctx.Err()
+	}
 
 	resp, err := cli.ContainerExecInspect(ctx, id.ID)
 	if err != nil {
-		return false, err
+		return -1, err
+	}
+	return resp.ExitCode, nil
+}
+
+// demultiplex splits a docker stream into stdout and stderr. Every frame starts
+// with an 8 byte header: the stream type, three zero bytes and the big endian
+// length of the frame.
+func demultiplex(stdout io.Writer, stderr io.Writer, src io.Reader) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(src, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var dst io.Writer
+		switch header[0] {
+		case 0, 1:
+			dst = stdout
+		case 2:
+			dst = stderr
+		default:
+			return fmt.Errorf("unknown stream type %d", header[0])
+		}
+
+		if _, err := io.CopyN(dst, src, int64(binary.BigEndian.Uint32(header[4:]))); err != nil {
+			return err
+		}
 	}
-	return resp.ExitCode == 0, nil
 }
 
-func Terminal(cli *client.Client, container string, args []string, file *os.File) (int, error) {
+func Terminal(cli *client.Client, container string, args []string, file *os.File) (exitCode int, err error) {
+	defer func() {
+		auditExec(container, args, exitCode, err)
+	}()
 
 	ctx := context.Background()
-	id, err := cli.ContainerExecCreate(ctx, container, types.ExecConfig{
+	id, err := execCreate(ctx, cli, container, types.ExecConfig{
 		Privileged:   true,
 		Tty:          terminal.IsTerminal(int(file.Fd())),
 		Detach:       false,
@@ -156,7 +558,30 @@ func Terminal(cli *client.Client, container string, args []string, file *os.File
 	return resp.ExitCode, nil
 }
 
+// ErrCleanupRequested is sent to the cleanup handler to remove the created resources on purpose, like
+// on an interrupt or once a foreground command is done, unlike errors sent because a command failed.
+type ErrCleanupRequested struct {
+	Reason string
+}
+
+func (e ErrCleanupRequested) Error() string {
+	return e.Reason
+}
+
+type CleanupOptions struct {
+	// Keep only reports the containers and volumes which would be removed on failure, so that they can
+	// be inspected. Resources are still removed on an ErrCleanupRequested.
+	Keep bool
+	// PreRemove is called for every container before it is removed, like for flushing logs in the node.
+	// Its errors are reported, but the container is removed anyway.
+	PreRemove func(container string) error
+}
+
 func NewCleanupHandler(cli *client.Client, errWriter io.Writer) (containers chan string, volumes chan string, done chan error) {
+	return NewCleanupHandlerWithOptions(cli, errWriter, CleanupOptions{})
+}
+
+func NewCleanupHandlerWithOptions(cli *client.Client, errWriter io.Writer, options CleanupOptions) (containers chan string, volumes chan string, done chan error) {
 
 	ctx := context.Background()
 
@@ -175,8 +600,21 @@ func NewCleanupHandler(cli *client.Client, errWriter io.Writer) (containers chan
 			case volume := <-volumes:
 				createdVolumes = append(createdVolumes, volume)
 			case err := <-done:
-				if err != nil {
+				_, requested := err.(ErrCleanupRequested)
+				if err != nil && options.Keep && !requested {
+					for _, c := range createdContainers {
+						fmt.Printf("keeping container: %v\n", c)
+					}
+					for _, v := range createdVolumes {
+						fmt.Printf("keeping volume: %v\n", v)
+					}
+				} else if err != nil {
 					for _, c := range createdContainers {
+						if options.PreRemove != nil {
+							if err := options.PreRemove(c); err != nil {
+								fmt.Fprintf(errWriter, "%v\n", err)
+							}
+						}
 						err := cli.ContainerRemove(ctx, c, types.ContainerRemoveOptions{Force: true})
 						fmt.Printf("container: %v\n", c)
 						if err != nil {
@@ -222,3 +660,35 @@ func PrintProgress(progressReader io.ReadCloser, writer *os.File) {
 		fmt.Print("\n")
 	}
 }
+
+// StartSpinner shows a spinner with the message until stop is called. Like PrintProgress
+// it only animates on a terminal, otherwise the message is printed once.
+func StartSpinner(writer *os.File, message string) (stop func()) {
+	if !terminal.IsTerminal(int(writer.Fd())) {
+		fmt.Fprintln(writer, message)
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		frames := `|/-\`
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			fmt.Fprintf(writer, "\r%c %s", frames[i%len(frames)], message)
+			select {
+			case <-done:
+				fmt.Fprint(writer, "\r"+strings.Repeat(" ", len(message)+2)+"\r")
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,118 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func frame(stream byte, payload string) []byte {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	return append(header, payload...)
+}
+
+func TestDemultiplex(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      [][]byte
+		wantStdout string
+		wantStderr string
+		wantErr    bool
+	}{
+		{"no frames", nil, "", "", false},
+		{"stdout", [][]byte{frame(1, "out")}, "out", "", false},
+		{"stdin is treated as stdout", [][]byte{frame(0, "in")}, "in", "", false},
+		{"stderr", [][]byte{frame(2, "err")}, "", "err", false},
+		{"interleaved", [][]byte{frame(1, "a"), frame(2, "b"), frame(1, "c")}, "ac", "b", false},
+		{"empty frame", [][]byte{frame(1, ""), frame(1, "a")}, "a", "", false},
+		{"unknown stream", [][]byte{frame(3, "x")}, "", "", true},
+		{"truncated header", [][]byte{frame(1, "a")[:4]}, "", "", true},
+		{"truncated payload", [][]byte{frame(1, "abc")[:10]}, "ab", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			err := demultiplex(&stdout, &stderr, bytes.NewReader(bytes.Join(test.input, nil)))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("expected error %v, got %v", test.wantErr, err)
+			}
+			if stdout.String() != test.wantStdout {
+				t.Errorf("expected stdout %q, got %q", test.wantStdout, stdout.String())
+			}
+			if stderr.String() != test.wantStderr {
+				t.Errorf("expected stderr %q, got %q", test.wantStderr, stderr.String())
+			}
+		})
+	}
+}
+
+// fakeDaemon returns a client for a docker daemon which answers every request with response
+func fakeDaemon(t *testing.T, response interface{}) (*client.Client, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))
+	cli, err := client.NewClient("tcp://"+server.Listener.Addr().String(), client.DefaultVersion, nil, nil)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return cli, server.Close
+}
+
+func TestWriteClusterPrefixes(t *testing.T) {
+	tests := []struct {
+		name       string
+		containers []types.Container
+		want       string
+	}{
+		{"no clusters", []types.Container{}, ""},
+		{
+			name: "sorted prefixes",
+			containers: []types.Container{
+				{Names: []string{"/kubevirt-dnsmasq"}},
+				{Names: []string{"/a-dnsmasq"}},
+			},
+			want: "a\nkubevirt\n",
+		},
+		{
+			name: "prefixes with dashes",
+			containers: []types.Container{
+				{Names: []string{"/k8s-1.10-dnsmasq"}},
+			},
+			want: "k8s-1.10\n",
+		},
+		{
+			name: "other containers are ignored",
+			containers: []types.Container{
+				{Names: []string{"/kubevirt-node01"}},
+				{Names: []string{"/dnsmasq-proxy"}},
+				{Names: []string{"/kubevirt-dnsmasq"}},
+			},
+			want: "kubevirt\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cli, stop := fakeDaemon(t, test.containers)
+			defer stop()
+
+			var out bytes.Buffer
+			if err := WriteClusterPrefixes(cli, &out); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.String() != test.want {
+				t.Errorf("expected %q, got %q", test.want, out.String())
+			}
+		})
+	}
+}
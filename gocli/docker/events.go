@@ -0,0 +1,53 @@
+package docker
+
+import (
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"strings"
+	"time"
+)
+
+// WatchCrashLoops watches the docker events of the cluster containers and calls onCrashLoop with the
+// container name and the number of recent exits once a container died at least threshold times
+// within window. A container restarted by its restart policy looks healthy whenever it is inspected
+// between two crashes, its exits show that docker keeps restarting it. onCrashLoop is called again
+// for every further exit while the container keeps crashing. It returns when the context is done.
+func WatchCrashLoops(ctx context.Context, cli *client.Client, prefix string, threshold int, window time.Duration, onCrashLoop func(container string, exits int)) error {
+	args := filters.NewArgs()
+	args.Add("type", "container")
+	args.Add("event", "die")
+	messages, errs := cli.Events(ctx, types.EventsOptions{Filters: args})
+
+	exits := map[string][]time.Time{}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		case msg := <-messages:
+			name := msg.Actor.Attributes["name"]
+			if !strings.HasPrefix(name, prefix+"-") {
+				continue
+			}
+
+			now := time.Unix(0, msg.TimeNano)
+			recent := []time.Time{}
+			for _, t := range exits[name] {
+				if now.Sub(t) <= window {
+					recent = append(recent, t)
+				}
+			}
+			exits[name] = append(recent, now)
+
+			if len(exits[name]) >= threshold {
+				onCrashLoop(name, len(exits[name]))
+			}
+		}
+	}
+}
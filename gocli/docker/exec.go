@@ -0,0 +1,377 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// ExecHandle references a command started with StartBackgroundExec.
+type ExecHandle struct {
+	cli       *client.Client
+	container string
+	args      []string
+	execID    string
+	pid       string
+	attached  types.HijackedResponse
+}
+
+// StartBackgroundExec starts the command in the container and returns without
+// waiting for it to finish. The command is wrapped in a shell which reports
+// its pid first, so that Stop can signal it from inside the container.
+func StartBackgroundExec(ctx context.Context, cli *client.Client, container string, args []string) (handle ExecHandle, err error) {
+	defer func() {
+		auditBackgroundExec(container, args, err)
+	}()
+
+	cmd := append([]string{"/bin/bash", "-c", `echo $$; exec "$@"`, "bash"}, args...)
+	id, err := execCreate(ctx, cli, container, types.ExecConfig{
+		Privileged:   true,
+		Tty:          true,
+		Detach:       false,
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return ExecHandle{}, err
+	}
+
+	attached, err := cli.ContainerExecAttach(ctx, id.ID, types.ExecConfig{
+		AttachStderr: true,
+		AttachStdout: true,
+		Tty:          true,
+	})
+	if err != nil {
+		return ExecHandle{}, err
+	}
+
+	pid, err := attached.Reader.ReadString('\n')
+	if err != nil {
+		attached.Close()
+		return ExecHandle{}, fmt.Errorf("reading pid of background command %v failed: %v", args, err)
+	}
+
+	return ExecHandle{
+		cli:       cli,
+		container: container,
+		args:      args,
+		execID:    id.ID,
+		pid:       strings.TrimSpace(pid),
+		attached:  attached,
+	}, nil
+}
+
+// Output returns the output stream of the background command.
+func (h ExecHandle) Output() io.Reader {
+	return h.attached.Reader
+}
+
+// Wait blocks until the output stream of the command is closed and returns its exit code.
+func (h ExecHandle) Wait() (int, error) {
+	io.Copy(ioutil.Discard, h.attached.Reader)
+	h.attached.Close()
+
+	resp, err := h.cli.ContainerExecInspect(context.Background(), h.execID)
+	if err != nil {
+		auditExec(h.container, h.args, -1, err)
+		return -1, err
+	}
+	auditExec(h.container, h.args, resp.ExitCode, nil)
+	return resp.ExitCode, nil
+}
+
+// Stop sends SIGTERM to the command and closes its output stream.
+func (h ExecHandle) Stop(ctx context.Context) error {
+	defer h.attached.Close()
+
+	resp, err := h.cli.ContainerExecInspect(ctx, h.execID)
+	if err != nil {
+		return err
+	}
+	if !resp.Running {
+		return nil
+	}
+
+	_, err = execWithExitCode(ctx, h.cli, h.container, []string{"kill", "-TERM", h.pid}, ioutil.Discard)
+	return err
+}
+
+// KillProcessInContainer sends signal to all processes with the given name in the container. It
+// fails if no such process exists. The processes are looked up through /proc, since minimal images
+// often ship without pkill. The name is matched against the executable of the command line, the
+// kernel truncates comm to 15 characters and only processes without command line, like kernel
+// threads, are matched by it.
+func KillProcessInContainer(ctx context.Context, cli *client.Client, container string, processName string, signal string) error {
+	script := `found=0
+for p in /proc/[0-9]*; do
+  pid="${p#/proc/}"
+  [ "$pid" = "$$" ] && continue
+  arg0=""
+  read -r -d '' arg0 < "$p/cmdline" 2>/dev/null
+  if [ -n "$arg0" ]; then
+    name="${arg0##*/}"
+  else
+    name="$(cat "$p/comm" 2>/dev/null)"
+  fi
+  if [ "$name" = "$0" ]; then
+    kill -s "$1" "$pid" && found=1
+  fi
+done
+[ "$found" = 1 ]`
+
+	var out bytes.Buffer
+	exitCode, err := execWithExitCode(ctx, cli, container, []string{"/bin/bash", "-c", script, processName, signal}, &out)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("sending %s to process %s in container %s failed: %s", signal, processName, container, out.String())
+	}
+	return nil
+}
+
+// ExecParseKV runs the command and parses every output line of the form <key><sep><value> into a
+// map. Empty lines, comments and lines without sep are skipped, quotes around values are removed.
+func ExecParseKV(cli *client.Client, container string, args []string, sep string) (map[string]string, error) {
+	var stdout, stderr bytes.Buffer
+	exitCode, err := execAttached(context.Background(), cli, container, args, false, &stdout, &stderr)
+	if err != nil {
+		return nil, err
+	}
+	if exitCode != 0 {
+		return nil, fmt.Errorf("command %v in container %s failed with exit code %d: %s", args, container, exitCode, stderr.String())
+	}
+
+	return parseKV(stdout.String(), sep), nil
+}
+
+// parseKV parses the lines of output like ExecParseKV
+func parseKV(output string, sep string) map[string]string {
+	values := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, sep, 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[strings.TrimSpace(parts[0])] = value
+	}
+	return values
+}
+
+type OutputMode int
+
+const (
+	// OutputStream passes output on as soon as it arrives, for interactive use
+	OutputStream OutputMode = iota
+	// OutputLines passes output on in complete lines, so that lines of commands
+	// which share a writer don't interleave
+	OutputLines
+)
+
+type ExecOptions struct {
+	// StripANSI removes ANSI escape sequences, like colors, from the output
+	StripANSI bool
+	// Umask, like 0022, is set before the command is started. It does not
+	// propagate into the node VM when the command goes through ssh.sh.
+	Umask string
+	// OutputMode defaults to OutputStream
+	OutputMode OutputMode
+}
+
+// ExecWithOptions runs the command like ExecWithContext, with the output processed according to options, and returns its exit code.
+func ExecWithOptions(ctx context.Context, cli *client.Client, container string, args []string, out io.Writer, options ExecOptions) (int, error) {
+	if options.Umask != "" {
+		if _, err := strconv.ParseUint(options.Umask, 8, 32); err != nil {
+			return -1, fmt.Errorf("invalid umask %s", options.Umask)
+		}
+		args = append([]string{"/bin/sh", "-c", `umask "$0" && exec "$@"`, options.Umask}, args...)
+	}
+
+	var lines *lineWriter
+	if options.OutputMode == OutputLines {
+		lines = &lineWriter{out: out}
+		out = lines
+	}
+	if options.StripANSI {
+		out = &ansiStripper{out: out}
+	}
+
+	exitCode, err := execWithExitCode(ctx, cli, container, args, out)
+	if lines != nil {
+		if flushErr := lines.Flush(); err == nil && flushErr != nil {
+			return -1, flushErr
+		}
+	}
+	return exitCode, err
+}
+
+// lineWriter buffers everything written to it and passes it on one complete line per write.
+type lineWriter struct {
+	out     io.Writer
+	pending []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.pending = append(l.pending, p...)
+	for {
+		i := bytes.IndexByte(l.pending, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		if _, err := l.out.Write(l.pending[:i+1]); err != nil {
+			return 0, err
+		}
+		l.pending = l.pending[i+1:]
+	}
+}
+
+// Flush writes a last line which was not terminated by a newline.
+func (l *lineWriter) Flush() error {
+	if len(l.pending) == 0 {
+		return nil
+	}
+	_, err := l.out.Write(l.pending)
+	l.pending = nil
+	return err
+}
+
+const (
+	ansiText = iota
+	ansiEscape
+	ansiCSI
+	ansiOSC
+)
+
+// ansiStripper drops ANSI escape sequences from everything written to it. It keeps
+// its state between writes, so sequences may be split across multiple writes.
+type ansiStripper struct {
+	out   io.Writer
+	state int
+}
+
+func (a *ansiStripper) Write(p []byte) (int, error) {
+	text := make([]byte, 0, len(p))
+	for _, b := range p {
+		switch a.state {
+		case ansiText:
+			if b == 0x1b {
+				a.state = ansiEscape
+			} else {
+				text = append(text, b)
+			}
+		case ansiEscape:
+			switch b {
+			case '[':
+				a.state = ansiCSI
+			case ']':
+				a.state = ansiOSC
+			default:
+				// two byte sequence
+				a.state = ansiText
+			}
+		case ansiCSI:
+			// parameters and intermediate bytes are followed by a final byte
+			if b >= 0x40 && b <= 0x7e {
+				a.state = ansiText
+			}
+		case ansiOSC:
+			// terminated by BEL or by ESC \, which the escape state consumes
+			if b == 0x07 {
+				a.state = ansiText
+			} else if b == 0x1b {
+				a.state = ansiEscape
+			}
+		}
+	}
+	if _, err := a.out.Write(text); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+var (
+	warningPrefixes = []string{"WARN", "W:", "[WARN"}
+	errorPrefixes   = []string{"ERROR", "FATAL", "E:", "[ERROR", "[FATAL"}
+	// Foreground red and yellow, as used by most tools for errors and warnings
+	errorColors   = []string{"\x1b[31m", "\x1b[91m", "\x1b[1;31m", "\x1b[31;1m"}
+	warningColors = []string{"\x1b[33m", "\x1b[93m", "\x1b[1;33m", "\x1b[33;1m"}
+)
+
+// ExecWithSeverity runs the command like ExecWithContext and calls onLine for every output line,
+// without ANSI escape sequences, together with its severity. Lines are classified by a leading
+// ERROR, WARN or INFO like marker, or by being colored red or yellow, and are info otherwise.
+func ExecWithSeverity(ctx context.Context, cli *client.Client, container string, args []string, onLine func(severity Severity, line string)) (int, error) {
+	lines := &lineWriter{out: &severityWriter{onLine: onLine}}
+	exitCode, err := execWithExitCode(ctx, cli, container, args, lines)
+	if flushErr := lines.Flush(); err == nil && flushErr != nil {
+		return -1, flushErr
+	}
+	return exitCode, err
+}
+
+// severityWriter expects one line per write, like from lineWriter
+type severityWriter struct {
+	onLine func(severity Severity, line string)
+}
+
+func (s *severityWriter) Write(p []byte) (int, error) {
+	var stripped bytes.Buffer
+	if _, err := (&ansiStripper{out: &stripped}).Write(p); err != nil {
+		return 0, err
+	}
+	line := strings.TrimRight(stripped.String(), "\r\n")
+	s.onLine(classifySeverity(string(p), line), line)
+	return len(p), nil
+}
+
+func classifySeverity(raw string, line string) Severity {
+	marker := strings.ToUpper(strings.TrimSpace(line))
+	for _, prefix := range errorPrefixes {
+		if strings.HasPrefix(marker, prefix) {
+			return SeverityError
+		}
+	}
+	for _, prefix := range warningPrefixes {
+		if strings.HasPrefix(marker, prefix) {
+			return SeverityWarning
+		}
+	}
+	if strings.HasPrefix(marker, "INFO") || strings.HasPrefix(marker, "[INFO") {
+		return SeverityInfo
+	}
+
+	for _, color := range errorColors {
+		if strings.Contains(raw, color) {
+			return SeverityError
+		}
+	}
+	for _, color := range warningColors {
+		if strings.Contains(raw, color) {
+			return SeverityWarning
+		}
+	}
+	return SeverityInfo
+}
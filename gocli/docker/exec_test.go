@@ -0,0 +1,144 @@
+package docker
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseKV(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		sep    string
+		want   map[string]string
+	}{
+		{"empty", "", "=", map[string]string{}},
+		{"os-release", "NAME=\"CentOS Linux\"\nVERSION_ID='7'\nID=centos\n", "=", map[string]string{"NAME": "CentOS Linux", "VERSION_ID": "7", "ID": "centos"}},
+		{"comments and empty lines", "# comment\n\nA=1\n  # indented comment\n", "=", map[string]string{"A": "1"}},
+		{"lines without separator", "A=1\nnot a pair\n", "=", map[string]string{"A": "1"}},
+		{"separator in value", "URL=http://host/?a=b\n", "=", map[string]string{"URL": "http://host/?a=b"}},
+		{"other separator with spaces", "Server Version: 1.13.1\nStorage Driver : overlay2\n", ":", map[string]string{"Server Version": "1.13.1", "Storage Driver": "overlay2"}},
+		{"mismatched quotes are kept", "A=\"1'\nB=\"\n", "=", map[string]string{"A": "\"1'", "B": "\""}},
+		{"empty value", "A=\nB=\"\"\n", "=", map[string]string{"A": "", "B": ""}},
+		{"crlf line endings", "A=1\r\nB=2\r\n", "=", map[string]string{"A": "1", "B": "2"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if values := parseKV(test.output, test.sep); !reflect.DeepEqual(values, test.want) {
+				t.Errorf("expected %v, got %v", test.want, values)
+			}
+		})
+	}
+}
+
+func TestAnsiStripper(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"plain text", []string{"hello\n"}, "hello\n"},
+		{"color", []string{"\x1b[31mred\x1b[0m text"}, "red text"},
+		{"two byte sequence", []string{"a\x1bcb"}, "ab"},
+		{"osc terminated by bel", []string{"\x1b]0;title\x07text"}, "text"},
+		{"osc terminated by st", []string{"\x1b]0;title\x1b\\text"}, "text"},
+		{"escape split after esc", []string{"a\x1b", "[1;31mb"}, "ab"},
+		{"csi split in parameters", []string{"a\x1b[1;", "31", "mb"}, "ab"},
+		{"osc split across writes", []string{"\x1b]0;ti", "tle\x07", "text"}, "text"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			stripper := &ansiStripper{out: &out}
+			for _, w := range test.writes {
+				n, err := stripper.Write([]byte(w))
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if n != len(w) {
+					t.Errorf("expected %d bytes to be written, got %d", len(w), n)
+				}
+			}
+			if out.String() != test.want {
+				t.Errorf("expected %q, got %q", test.want, out.String())
+			}
+		})
+	}
+}
+
+// recordingWriter keeps every write separately
+type recordingWriter struct {
+	writes []string
+}
+
+func (r *recordingWriter) Write(p []byte) (int, error) {
+	r.writes = append(r.writes, string(p))
+	return len(p), nil
+}
+
+func TestLineWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   []string
+	}{
+		{"one line", []string{"a\n"}, []string{"a\n"}},
+		{"multiple lines in one write", []string{"a\nb\n"}, []string{"a\n", "b\n"}},
+		{"line split across writes", []string{"a", "b", "c\n"}, []string{"abc\n"}},
+		{"unterminated last line", []string{"a\nb"}, []string{"a\n", "b"}},
+		{"empty lines", []string{"\n\n"}, []string{"\n", "\n"}},
+		{"nothing written", []string{}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := &recordingWriter{}
+			lines := &lineWriter{out: out}
+			for _, w := range test.writes {
+				if _, err := lines.Write([]byte(w)); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if err := lines.Flush(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(out.writes, test.want) {
+				t.Errorf("expected %q, got %q", test.want, out.writes)
+			}
+		})
+	}
+}
+
+func TestClassifySeverity(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want Severity
+	}{
+		{"everything is fine", SeverityInfo},
+		{"ERROR: disk full", SeverityError},
+		{"  fatal: bad object", SeverityError},
+		{"E: Unable to locate package", SeverityError},
+		{"[ERROR] failed", SeverityError},
+		{"WARNING: deprecated", SeverityWarning},
+		{"W: Some index files failed", SeverityWarning},
+		{"[warn] slow", SeverityWarning},
+		{"INFO: colored \x1b[31mred\x1b[0m", SeverityInfo},
+		{"\x1b[31mfailed\x1b[0m", SeverityError},
+		{"\x1b[1;33mcareful\x1b[0m", SeverityWarning},
+		{"\x1b[32mgreen\x1b[0m", SeverityInfo},
+		{"\x1b[31mERROR\x1b[0m: colored marker", SeverityError},
+	}
+
+	for _, test := range tests {
+		var line bytes.Buffer
+		if _, err := (&ansiStripper{out: &line}).Write([]byte(test.raw)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if severity := classifySeverity(test.raw, line.String()); severity != test.want {
+			t.Errorf("expected severity %d for %q, got %d", test.want, test.raw, severity)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package docker
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+type PullStats struct {
+	Duration time.Duration
+	// TotalBytes is the compressed size of all downloaded layers
+	TotalBytes int64
+	// MBPerSecond is the average download rate over the whole pull
+	MBPerSecond float64
+}
+
+type pullMessage struct {
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+}
+
+// PullImageWithStats pulls the image while printing the progress like PrintProgress and
+// returns how long the pull took and how much data was downloaded.
+func PullImageWithStats(ctx context.Context, cli *client.Client, ref string, writer *os.File) (*PullStats, error) {
+	start := time.Now()
+
+	reader, err := cli.ImagePull(ctx, ref, types.ImagePullOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	progressReader, progressWriter := io.Pipe()
+	printed := make(chan struct{})
+	go func() {
+		PrintProgress(progressReader, writer)
+		close(printed)
+	}()
+
+	layers := map[string]int64{}
+	scanner := bufio.NewScanner(io.TeeReader(reader, progressWriter))
+	for scanner.Scan() {
+		msg := pullMessage{}
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			continue
+		}
+		if msg.Status == "Downloading" && msg.ProgressDetail.Total > layers[msg.ID] {
+			layers[msg.ID] = msg.ProgressDetail.Total
+		}
+	}
+	progressWriter.CloseWithError(scanner.Err())
+	<-printed
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	stats := &PullStats{Duration: time.Since(start)}
+	for _, size := range layers {
+		stats.TotalBytes += size
+	}
+	if stats.Duration > 0 {
+		stats.MBPerSecond = float64(stats.TotalBytes) / 1000 / 1000 / stats.Duration.Seconds()
+	}
+	return stats, nil
+}
+
+// CommitContainer creates an image with the given reference from the container and returns the image ID.
+func CommitContainer(ctx context.Context, cli *client.Client, container string, ref string, changes []string) (string, error) {
+	resp, err := cli.ContainerCommit(ctx, container, types.ContainerCommitOptions{
+		Reference: ref,
+		Changes:   changes,
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// ProvisionAndSnapshot runs the provision script from the node container in its VM, shuts the VM
+// down and commits the container to ref, which can then be used as a pre-provisioned cluster image.
+// The container is removed afterwards. Data in volumes is not part of the image, so when the VM
+// writes to a disk in the /var/run/disk volume, like the nodes created by run, that disk is copied
+// next to the disks of the image as the following /diskNN.qcow2, which vm.sh picks up as the base
+// of the next disk.
+func ProvisionAndSnapshot(ctx context.Context, cli *client.Client, container string, script string, ref string, out io.Writer) (string, error) {
+	details, err := cli.ContainerInspect(ctx, container)
+	if err != nil {
+		return "", err
+	}
+	diskVolume := false
+	for _, m := range details.Mounts {
+		if m.Type == mount.TypeVolume && path.Clean(m.Destination) == "/var/run/disk" {
+			diskVolume = true
+		}
+	}
+
+	steps := [][]string{
+		{"/bin/bash", "-c", "while [ ! -f /ssh_ready ] ; do sleep 1; done"},
+		{"/bin/bash", "-c", fmt.Sprintf("ssh.sh sudo /bin/bash < %s", script)},
+	}
+	for _, step := range steps {
+		success, err := ExecWithContext(ctx, cli, container, step, out)
+		if err != nil {
+			return "", err
+		}
+		if !success {
+			return "", fmt.Errorf("provisioning container %s failed at %v", container, step)
+		}
+	}
+
+	var snapshotDisk string
+	if diskVolume {
+		// Same numbering as calc_next_disk in vm.sh
+		var stdout, stderr bytes.Buffer
+		exitCode, err := execAttached(ctx, cli, container, []string{"/bin/bash", "-c", `cd / && last="$(ls -t disk*.qcow2 2>/dev/null | head -1 | sed -e 's/disk//' -e 's/.qcow2//')" && printf "disk%02d.qcow2" $((10#${last:-00}+1))`}, false, &stdout, &stderr)
+		if err != nil {
+			return "", err
+		}
+		if exitCode != 0 {
+			return "", fmt.Errorf("finding the next disk of container %s failed with exit code %d: %s", container, exitCode, stderr.String())
+		}
+		snapshotDisk = stdout.String()
+	}
+
+	// ssh.sh and /ssh_ready must not end up in the image. The VM stops the container when it is down,
+	// so ssh.sh is moved to /dev/shm, which is not committed, instead of being removed afterwards.
+	// The shutdown closes the ssh connection, so its exit code is not checked.
+	shutdown := []string{"/bin/bash", "-c", "rm /ssh_ready && mv /usr/local/bin/ssh.sh /dev/shm/ssh.sh && (/dev/shm/ssh.sh sudo shutdown -h now || true)"}
+	success, err := ExecWithContext(ctx, cli, container, shutdown, out)
+	if err != nil {
+		return "", err
+	}
+	if !success {
+		return "", fmt.Errorf("shutting down the VM of container %s failed", container)
+	}
+
+	if _, err := cli.ContainerWait(ctx, container); err != nil {
+		return "", err
+	}
+
+	if diskVolume {
+		if err := copyDiskToRoot(ctx, cli, container, "/var/run/disk/disk.qcow2", snapshotDisk); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := CommitContainer(ctx, cli, container, ref, []string{"ENV PROVISIONED TRUE"}); err != nil {
+		return "", err
+	}
+
+	if err := cli.ContainerRemove(ctx, container, types.ContainerRemoveOptions{Force: true}); err != nil {
+		return "", err
+	}
+	return ref, nil
+}
+
+// copyDiskToRoot copies the disk at src of the stopped container to /name in its filesystem
+func copyDiskToRoot(ctx context.Context, cli *client.Client, container string, src string, name string) error {
+	reader, _, err := cli.CopyFromContainer(ctx, container, src)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	archive, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(renameTarEntry(tar.NewReader(reader), tar.NewWriter(writer), name))
+	}()
+	err = cli.CopyToContainer(ctx, container, "/", archive, types.CopyToContainerOptions{})
+	archive.Close()
+	return err
+}
+
+// renameTarEntry copies the single file of an archive to dst under the given name
+func renameTarEntry(src *tar.Reader, dst *tar.Writer, name string) error {
+	header, err := src.Next()
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := dst.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+	return dst.Close()
+}
+
+// ContainerUsesLatestImage returns whether the container runs the image which ref currently points to locally.
+func ContainerUsesLatestImage(ctx context.Context, cli *client.Client, container string, ref string) (bool, error) {
+	details, err := cli.ContainerInspect(ctx, container)
+	if err != nil {
+		return false, err
+	}
+	image, _, err := cli.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		return false, err
+	}
+	return details.Image == image.ID, nil
+}
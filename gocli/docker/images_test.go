@@ -0,0 +1,39 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestRenameTarEntry(t *testing.T) {
+	var src bytes.Buffer
+	writer := tar.NewWriter(&src)
+	if err := writer.WriteHeader(&tar.Header{Name: "disk.qcow2", Mode: 0644, Size: 4}); err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte("qcow"))
+	writer.Close()
+
+	var dst bytes.Buffer
+	if err := renameTarEntry(tar.NewReader(&src), tar.NewWriter(&dst), "disk02.qcow2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	reader := tar.NewReader(&dst)
+	header, err := reader.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Name != "disk02.qcow2" || header.Mode != 0644 {
+		t.Errorf("expected disk02.qcow2 with mode 0644, got %s with mode %o", header.Name, header.Mode)
+	}
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "qcow" {
+		t.Errorf("expected the content to be copied, got %q", content)
+	}
+}
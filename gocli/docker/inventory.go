@@ -0,0 +1,172 @@
+package docker
+
+import (
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"sort"
+	"strings"
+)
+
+// Inventory lists the docker resources of all clusters, keyed by cluster prefix.
+type Inventory struct {
+	Clusters map[string]*ClusterInventory
+}
+
+type ClusterInventory struct {
+	Containers []InventoryContainer
+	Volumes    []InventoryVolume
+	// Networks the cluster containers are attached to, besides the default ones
+	Networks []string
+	Images   []InventoryImage
+}
+
+type InventoryContainer struct {
+	Name  string
+	ID    string
+	State string
+	// Size of the writable layer in bytes
+	Size int64
+}
+
+type InventoryVolume struct {
+	Name string
+	// Size in bytes, or -1 if the daemon does not report it
+	Size int64
+}
+
+type InventoryImage struct {
+	ID   string
+	Tags []string
+	Size int64
+}
+
+// InventoryAll returns all kubevirtci containers, volumes, networks and images on the host. Clusters
+// are found by their dnsmasq containers and by the cluster label of volumes, so that leftovers of
+// clusters without containers are reported as well.
+func InventoryAll(ctx context.Context, cli *client.Client) (Inventory, error) {
+	inventory := Inventory{Clusters: map[string]*ClusterInventory{}}
+	cluster := func(prefix string) *ClusterInventory {
+		if _, exists := inventory.Clusters[prefix]; !exists {
+			inventory.Clusters[prefix] = &ClusterInventory{
+				Containers: []InventoryContainer{},
+				Volumes:    []InventoryVolume{},
+				Networks:   []string{},
+				Images:     []InventoryImage{},
+			}
+		}
+		return inventory.Clusters[prefix]
+	}
+
+	prefixes, err := ListClusterPrefixes(cli)
+	if err != nil {
+		return inventory, err
+	}
+
+	volumes, err := cli.VolumeList(ctx, filters.NewArgs())
+	if err != nil {
+		return inventory, err
+	}
+	for _, v := range volumes.Volumes {
+		if prefix, exists := v.Labels[LABEL_CLUSTER]; exists && !containsString(prefixes, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	// Longer prefixes first, so that a container of cluster a-b is not assigned to cluster a
+	sort.Slice(prefixes, func(i, j int) bool {
+		return len(prefixes[i]) > len(prefixes[j])
+	})
+	prefixOf := func(name string) string {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(strings.TrimPrefix(name, "/"), prefix+"-") {
+				return prefix
+			}
+		}
+		return ""
+	}
+
+	for _, v := range volumes.Volumes {
+		prefix := v.Labels[LABEL_CLUSTER]
+		if lockPrefix, exists := v.Labels[LABEL_LOCK]; exists {
+			prefix = lockPrefix
+		} else if prefix == "" && v.Labels[LABEL_OWNER] == "" {
+			prefix = prefixOf(v.Name)
+		}
+		if prefix == "" {
+			continue
+		}
+		size := int64(-1)
+		if v.UsageData != nil {
+			size = v.UsageData.Size
+		}
+		cluster(prefix).Volumes = append(cluster(prefix).Volumes, InventoryVolume{Name: v.Name, Size: size})
+	}
+
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true, Size: true})
+	if err != nil {
+		return inventory, err
+	}
+	clusterImages := map[string][]string{}
+	for _, c := range containers {
+		prefix := ""
+		for _, name := range c.Names {
+			if prefix = prefixOf(name); prefix != "" {
+				break
+			}
+		}
+		if prefix == "" {
+			continue
+		}
+
+		inv := cluster(prefix)
+		inv.Containers = append(inv.Containers, InventoryContainer{
+			Name:  strings.TrimPrefix(c.Names[0], "/"),
+			ID:    c.ID,
+			State: c.State,
+			Size:  c.SizeRw,
+		})
+		if c.NetworkSettings != nil {
+			for network := range c.NetworkSettings.Networks {
+				if network != "bridge" && network != "host" && network != "none" && !containsString(inv.Networks, network) {
+					inv.Networks = append(inv.Networks, network)
+				}
+			}
+		}
+		if !containsString(clusterImages[prefix], c.ImageID) {
+			clusterImages[prefix] = append(clusterImages[prefix], c.ImageID)
+		}
+	}
+
+	images, err := cli.ImageList(ctx, types.ImageListOptions{})
+	if err != nil {
+		return inventory, err
+	}
+	for prefix, ids := range clusterImages {
+		for _, image := range images {
+			if containsString(ids, image.ID) {
+				cluster(prefix).Images = append(cluster(prefix).Images, InventoryImage{
+					ID:   image.ID,
+					Tags: image.RepoTags,
+					Size: image.Size,
+				})
+			}
+		}
+	}
+
+	for _, inv := range inventory.Clusters {
+		sort.Slice(inv.Containers, func(i, j int) bool { return inv.Containers[i].Name < inv.Containers[j].Name })
+		sort.Slice(inv.Volumes, func(i, j int) bool { return inv.Volumes[i].Name < inv.Volumes[j].Name })
+		sort.Strings(inv.Networks)
+	}
+	return inventory, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const kubeconfig = "/etc/kubernetes/admin.conf"
+
+// GetKubeResource runs `kubectl get <resource> -o json` on the VM of the given node container and
+// returns the JSON output. resource may contain further kubectl arguments, like "pods -n kube-system".
+func GetKubeResource(ctx context.Context, cli *client.Client, controlContainer string, resource string) ([]byte, error) {
+	args := append([]string{"ssh.sh", "sudo", "kubectl", "--kubeconfig=" + kubeconfig, "get"}, strings.Fields(resource)...)
+	args = append(args, "-o", "json")
+
+	var stdout, stderr bytes.Buffer
+	exitCode, err := execAttached(ctx, cli, controlContainer, args, false, &stdout, &stderr)
+	if err != nil {
+		return nil, err
+	}
+	if exitCode != 0 {
+		return nil, fmt.Errorf("kubectl get %s failed with exit code %d: %s", resource, exitCode, stderr.String())
+	}
+	if !json.Valid(stdout.Bytes()) {
+		return nil, fmt.Errorf("kubectl get %s returned invalid json: %s", resource, stdout.String())
+	}
+	return stdout.Bytes(), nil
+}
+
+// WaitForAPIHealthz polls the /healthz endpoint of the API server on node01 until it reports ok.
+func WaitForAPIHealthz(ctx context.Context, cli *client.Client, prefix string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	control := prefix + "-" + "node01"
+	url := fmt.Sprintf("https://%s:%d/healthz", NodeIP("node01"), 6443)
+	last := ""
+	for {
+		var stdout, stderr bytes.Buffer
+		exitCode, err := execAttached(ctx, cli, control, []string{"curl", "-k", "-s", "-m", "5", url}, false, &stdout, &stderr)
+		if err == nil && exitCode == 0 && strings.TrimSpace(stdout.String()) == "ok" {
+			return nil
+		}
+		if err != nil {
+			last = err.Error()
+		} else {
+			last = strings.TrimSpace(stdout.String() + stderr.String())
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("api server did not become healthy within %v: %s", timeout, last)
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+const manifestsDir = "kubevirtci-manifests"
+
+// ApplyManifests applies all manifests in localDir and its subdirectories to the cluster. The
+// directory is copied into the node01 container and from there into its VM, where kubectl runs.
+func ApplyManifests(ctx context.Context, cli *client.Client, prefix string, localDir string) error {
+	var archive bytes.Buffer
+	if err := tarDirectory(localDir, manifestsDir, &archive); err != nil {
+		return err
+	}
+
+	control := prefix + "-" + "node01"
+	target := "/tmp/" + manifestsDir
+	// Leftovers of an earlier failed apply would be merged with the copied directory
+	if _, err := execAttached(ctx, cli, control, []string{"rm", "-rf", target}, false, ioutil.Discard, ioutil.Discard); err != nil {
+		return err
+	}
+	if err := cli.CopyToContainer(ctx, control, "/tmp", &archive, types.CopyToContainerOptions{}); err != nil {
+		return err
+	}
+
+	script := fmt.Sprintf(`tar -C /tmp -c %[1]s | ssh.sh "rm -rf %[2]s && tar -x -C /tmp" && rm -rf %[2]s && ssh.sh sudo kubectl --kubeconfig=%[3]s apply -R -f %[2]s`, manifestsDir, target, kubeconfig)
+
+	var stdout, stderr bytes.Buffer
+	exitCode, err := execAttached(ctx, cli, control, []string{"/bin/bash", "-c", script}, false, &stdout, &stderr)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("applying manifests from %s failed with exit code %d: %s", localDir, exitCode, strings.TrimSpace(stdout.String()+stderr.String()))
+	}
+	return nil
+}
+
+// tarDirectory writes the directories and regular files below dir into a tar stream, rooted at name
+func tarDirectory(dir string, name string, out io.Writer) error {
+	writer := tar.NewWriter(out)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(filepath.Join(name, rel))
+		if err := writer.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(writer, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}
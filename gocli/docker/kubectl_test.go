@@ -0,0 +1,77 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTarDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a.yaml":            "kind: A\n",
+		"sub/b.yaml":        "kind: B\n",
+		"sub/deeper/c.yaml": "kind: C\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only regular files and directories are archived
+	if err := os.Symlink(filepath.Join(dir, "a.yaml"), filepath.Join(dir, "link.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := tarDirectory(dir, "manifests", &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	entries := map[string]string{}
+	reader := tar.NewReader(&out)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			entries[header.Name] = "<dir>"
+		} else {
+			entries[header.Name] = string(content)
+		}
+	}
+
+	want := map[string]string{
+		"manifests":                   "<dir>",
+		"manifests/a.yaml":            "kind: A\n",
+		"manifests/sub":               "<dir>",
+		"manifests/sub/b.yaml":        "kind: B\n",
+		"manifests/sub/deeper":        "<dir>",
+		"manifests/sub/deeper/c.yaml": "kind: C\n",
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("expected %v, got %v", want, entries)
+	}
+}
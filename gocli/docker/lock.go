@@ -0,0 +1,165 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	LABEL_LOCK         = "io.kubevirtci.lock"
+	LABEL_LOCK_HOLDER  = "io.kubevirtci.lock.holder"
+	LABEL_LOCK_HOST    = "io.kubevirtci.lock.host"
+	LABEL_LOCK_PID     = "io.kubevirtci.lock.pid"
+	LABEL_LOCK_CREATED = "io.kubevirtci.lock.created"
+)
+
+// DEFAULT_LOCK_TTL is the age after which AcquireClusterLock considers a lock stale, even if its holder may still run
+const DEFAULT_LOCK_TTL = 6 * time.Hour
+
+// lockVolume is deliberately not named and labelled like cluster volumes, so
+// that removing or exporting a cluster does not touch its lock.
+func lockVolume(prefix string) string {
+	return "kubevirtci-lock-" + prefix
+}
+
+// AcquireClusterLock takes an exclusive lock on the cluster, so that concurrent gocli invocations
+// don't interfere with each other. The lock is a named volume: creating an existing volume returns
+// it unchanged, so only the caller whose holder label ends up on the volume owns the lock.
+// Stale locks are reclaimed like in AcquireClusterLockWithTTL with DEFAULT_LOCK_TTL.
+func AcquireClusterLock(ctx context.Context, cli *client.Client, prefix string) (release func(), err error) {
+	return AcquireClusterLockWithTTL(ctx, cli, prefix, DEFAULT_LOCK_TTL)
+}
+
+// AcquireClusterLockWithTTL is like AcquireClusterLock, but if the cluster is locked by a process
+// which no longer exists on this host, or the lock is older than ttl, it prints a warning and
+// takes the lock over. Only one process can take over a stale lock: the reclaimer first creates
+// a marker volume named after the stale holder, which like the lock itself only one caller ends
+// up owning, and only that caller replaces the lock. A reclaimer which dies before it removes the
+// marker blocks further reclaims of that lock, the error names the volumes to remove by hand then.
+// A holder which outlived the ttl can still release the lock while it is reclaimed.
+func AcquireClusterLockWithTTL(ctx context.Context, cli *client.Client, prefix string, ttl time.Duration) (release func(), err error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	holder := fmt.Sprintf("%s-%d-%d", host, os.Getpid(), now.UnixNano())
+
+	create := func() (types.Volume, error) {
+		return cli.VolumeCreate(ctx, volume.VolumesCreateBody{
+			Name: lockVolume(prefix),
+			Labels: map[string]string{
+				LABEL_LOCK:         prefix,
+				LABEL_OWNER:        OWNER_GOCLI,
+				LABEL_LOCK_HOLDER:  holder,
+				LABEL_LOCK_HOST:    host,
+				LABEL_LOCK_PID:     strconv.Itoa(os.Getpid()),
+				LABEL_LOCK_CREATED: now.UTC().Format(time.RFC3339),
+			},
+		})
+	}
+	locked := func(vol types.Volume) error {
+		return fmt.Errorf("cluster %s is locked by process %s on %s since %s", prefix, vol.Labels[LABEL_LOCK_PID], vol.Labels[LABEL_LOCK_HOST], vol.Labels[LABEL_LOCK_CREATED])
+	}
+
+	vol, err := create()
+	if err != nil {
+		return nil, err
+	}
+
+	if vol.Labels[LABEL_LOCK_HOLDER] != holder {
+		reason := staleLockReason(vol.Labels, host, ttl)
+		if reason == "" {
+			return nil, locked(vol)
+		}
+		if err := reclaimLock(ctx, cli, prefix, vol.Labels[LABEL_LOCK_HOLDER], holder, reason); err != nil {
+			return nil, err
+		}
+
+		vol, err = create()
+		if err != nil {
+			return nil, err
+		}
+		if vol.Labels[LABEL_LOCK_HOLDER] != holder {
+			return nil, locked(vol)
+		}
+	}
+
+	return func() {
+		// Only remove the lock if it was not reclaimed by someone else in the meantime
+		current, err := cli.VolumeInspect(context.Background(), vol.Name)
+		if err == nil && current.Labels[LABEL_LOCK_HOLDER] == holder {
+			cli.VolumeRemove(context.Background(), vol.Name, false)
+		}
+	}, nil
+}
+
+// reclaimLock removes the lock of the cluster if staleHolder still holds it and no other process
+// reclaims it at the same time.
+func reclaimLock(ctx context.Context, cli *client.Client, prefix string, staleHolder string, holder string, reason string) error {
+	marker, err := cli.VolumeCreate(ctx, volume.VolumesCreateBody{
+		Name: lockVolume(prefix) + "-reclaim-" + staleHolder,
+		Labels: map[string]string{
+			LABEL_LOCK:        prefix,
+			LABEL_OWNER:       OWNER_GOCLI,
+			LABEL_LOCK_HOLDER: holder,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if marker.Labels[LABEL_LOCK_HOLDER] != holder {
+		return fmt.Errorf("the stale lock of cluster %s is reclaimed by another process, if no gocli runs anymore remove the volumes %s and %s", prefix, lockVolume(prefix), marker.Name)
+	}
+
+	fmt.Fprintf(os.Stderr, "WARNING: reclaiming stale lock of cluster %s, %s\n", prefix, reason)
+	current, err := cli.VolumeInspect(ctx, lockVolume(prefix))
+	if err != nil && !isNoSuchVolume(err) {
+		return err
+	}
+	// The lock may have been released by its holder, or taken by someone else after that
+	if err == nil && current.Labels[LABEL_LOCK_HOLDER] == staleHolder {
+		if err := cli.VolumeRemove(ctx, current.Name, false); err != nil && !isNoSuchVolume(err) {
+			return err
+		}
+	}
+	return cli.VolumeRemove(ctx, marker.Name, false)
+}
+
+// staleLockReason returns why the lock with the given labels is stale, or an empty string if it is not
+func staleLockReason(labels map[string]string, host string, ttl time.Duration) string {
+	created, err := time.Parse(time.RFC3339, labels[LABEL_LOCK_CREATED])
+	if err != nil {
+		return fmt.Sprintf("its creation time %q is invalid", labels[LABEL_LOCK_CREATED])
+	}
+	if age := time.Since(created); age > ttl {
+		return fmt.Sprintf("it was taken %v ago by process %s on %s", age.Round(time.Second), labels[LABEL_LOCK_PID], labels[LABEL_LOCK_HOST])
+	}
+
+	// Processes can only be checked on the same host
+	if labels[LABEL_LOCK_HOST] != host {
+		return ""
+	}
+	pid, err := strconv.Atoi(labels[LABEL_LOCK_PID])
+	if err != nil {
+		return fmt.Sprintf("its process id %q is invalid", labels[LABEL_LOCK_PID])
+	}
+	if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+		return fmt.Sprintf("its process %d on %s does not exist anymore", pid, host)
+	}
+	return ""
+}
+
+// isNoSuchVolume recognizes missing volumes by the daemon message, the client does not return
+// typed errors for volume removals
+func isNoSuchVolume(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "no such volume")
+}
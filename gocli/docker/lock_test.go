@@ -0,0 +1,173 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStaleLockReason(t *testing.T) {
+	// The pid of a process which exited and was reaped
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	recent := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	old := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	own := strconv.Itoa(os.Getpid())
+
+	tests := []struct {
+		name      string
+		labels    map[string]string
+		wantStale bool
+	}{
+		{"running process on this host", map[string]string{LABEL_LOCK_CREATED: recent, LABEL_LOCK_HOST: "this", LABEL_LOCK_PID: own}, false},
+		{"exited process on this host", map[string]string{LABEL_LOCK_CREATED: recent, LABEL_LOCK_HOST: "this", LABEL_LOCK_PID: strconv.Itoa(exited.Process.Pid)}, true},
+		{"process on another host", map[string]string{LABEL_LOCK_CREATED: recent, LABEL_LOCK_HOST: "other", LABEL_LOCK_PID: "1"}, false},
+		{"older than the ttl", map[string]string{LABEL_LOCK_CREATED: old, LABEL_LOCK_HOST: "this", LABEL_LOCK_PID: own}, true},
+		{"older than the ttl on another host", map[string]string{LABEL_LOCK_CREATED: old, LABEL_LOCK_HOST: "other", LABEL_LOCK_PID: "1"}, true},
+		{"invalid creation time", map[string]string{LABEL_LOCK_CREATED: "yesterday", LABEL_LOCK_HOST: "this", LABEL_LOCK_PID: own}, true},
+		{"invalid pid", map[string]string{LABEL_LOCK_CREATED: recent, LABEL_LOCK_HOST: "this", LABEL_LOCK_PID: "x"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reason := staleLockReason(test.labels, "this", time.Hour)
+			if stale := reason != ""; stale != test.wantStale {
+				t.Errorf("expected stale %v, got %v with reason %q", test.wantStale, stale, reason)
+			}
+		})
+	}
+}
+
+// fakeVolumeDaemon returns a client for a docker daemon which only knows volumes, starting with the given ones
+func fakeVolumeDaemon(t *testing.T, volumes map[string]types.Volume) (*client.Client, func()) {
+	lock := sync.Mutex{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		name := r.URL.Path[strings.Index(r.URL.Path, "/volumes/")+len("/volumes/"):]
+		if r.Method == http.MethodPost && name == "create" {
+			var body volume.VolumesCreateBody
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, exists := volumes[body.Name]; !exists {
+				volumes[body.Name] = types.Volume{Name: body.Name, Labels: body.Labels}
+			}
+			name = body.Name
+		}
+
+		vol, exists := volumes[name]
+		if !exists {
+			http.Error(w, `{"message": "no such volume"}`, http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(volumes, name)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(vol)
+	}))
+	cli, err := client.NewClient("tcp://"+server.Listener.Addr().String(), client.DefaultVersion, nil, nil)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return cli, server.Close
+}
+
+func TestAcquireClusterLock(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	own := strconv.Itoa(os.Getpid())
+	created := time.Now().UTC().Format(time.RFC3339)
+
+	lockLabels := func(pid string) map[string]string {
+		return map[string]string{
+			LABEL_LOCK:         "kubevirt",
+			LABEL_LOCK_HOLDER:  host + "-" + pid + "-1",
+			LABEL_LOCK_HOST:    host,
+			LABEL_LOCK_PID:     pid,
+			LABEL_LOCK_CREATED: created,
+		}
+	}
+	staleHolder := host + "-" + strconv.Itoa(exited.Process.Pid) + "-1"
+	marker := "kubevirtci-lock-kubevirt-reclaim-" + staleHolder
+
+	tests := []struct {
+		name    string
+		volumes map[string]types.Volume
+		wantErr string
+	}{
+		{
+			name:    "free",
+			volumes: map[string]types.Volume{},
+		},
+		{
+			name:    "held by a running process",
+			volumes: map[string]types.Volume{"kubevirtci-lock-kubevirt": {Name: "kubevirtci-lock-kubevirt", Labels: lockLabels(own)}},
+			wantErr: "cluster kubevirt is locked by process " + own,
+		},
+		{
+			name:    "stale",
+			volumes: map[string]types.Volume{"kubevirtci-lock-kubevirt": {Name: "kubevirtci-lock-kubevirt", Labels: lockLabels(strconv.Itoa(exited.Process.Pid))}},
+		},
+		{
+			name: "stale and reclaimed by another process",
+			volumes: map[string]types.Volume{
+				"kubevirtci-lock-kubevirt": {Name: "kubevirtci-lock-kubevirt", Labels: lockLabels(strconv.Itoa(exited.Process.Pid))},
+				marker:                     {Name: marker, Labels: map[string]string{LABEL_LOCK_HOLDER: "other"}},
+			},
+			wantErr: "remove the volumes kubevirtci-lock-kubevirt and " + marker,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cli, stop := fakeVolumeDaemon(t, test.volumes)
+			defer stop()
+
+			release, err := AcquireClusterLock(context.Background(), cli, "kubevirt")
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", test.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(test.volumes) != 1 || test.volumes["kubevirtci-lock-kubevirt"].Labels[LABEL_LOCK_PID] != own {
+				t.Errorf("expected only the lock of this process, got %v", test.volumes)
+			}
+			release()
+			if len(test.volumes) != 0 {
+				t.Errorf("expected the lock to be released, got %v", test.volumes)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"io"
+	"time"
+)
+
+// FollowLogs streams the logs of the container, starting with the last tail lines, until the context
+// is done or the container stopped for good. The log stream ends whenever the container stops, so
+// while the container is still running or restarting, it reconnects and continues where it ended.
+func FollowLogs(ctx context.Context, cli *client.Client, container string, tail string, stdout io.Writer, stderr io.Writer) error {
+	options := types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+		Tail:       tail,
+	}
+
+	for {
+		details, err := cli.ContainerInspect(ctx, container)
+		if err != nil {
+			return err
+		}
+
+		reader, err := cli.ContainerLogs(ctx, container, options)
+		if err != nil {
+			return err
+		}
+		if details.Config.Tty {
+			_, err = io.Copy(stdout, reader)
+		} else {
+			err = demultiplex(stdout, stderr, reader)
+		}
+		reader.Close()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Only continue with what was logged after the stream ended
+		ended := time.Now()
+		options.Tail = "all"
+		options.Since = fmt.Sprintf("%d.%09d", ended.Unix(), ended.Nanosecond())
+
+		running, err := waitWhileRestarting(ctx, cli, container)
+		if err != nil || !running {
+			return err
+		}
+	}
+}
+
+// waitWhileRestarting returns whether the container is running once it is no longer restarting
+func waitWhileRestarting(ctx context.Context, cli *client.Client, container string) (bool, error) {
+	for {
+		details, err := cli.ContainerInspect(ctx, container)
+		if err != nil {
+			if ctx.Err() != nil {
+				return false, nil
+			}
+			return false, err
+		}
+		if !details.State.Restarting {
+			return details.State.Running, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, nil
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ClusterManifest describes all containers and volumes of a cluster. Names of
+// containers and volumes are stored without the cluster prefix, so that the
+// cluster can be recreated under a different prefix.
+type ClusterManifest struct {
+	Prefix     string              `json:"prefix"`
+	Containers []ContainerManifest `json:"containers"`
+	Volumes    []string            `json:"volumes"`
+}
+
+type ContainerManifest struct {
+	Name       string                `json:"name"`
+	Config     *container.Config     `json:"config"`
+	HostConfig *container.HostConfig `json:"hostConfig"`
+	// Networks the container was attached to in addition to its network mode
+	Networks []string `json:"networks,omitempty"`
+}
+
+// ExportClusterManifest returns the JSON manifest of the cluster. Containers are ordered by
+// creation time, so that dnsmasq is created before the containers which join its network.
+func ExportClusterManifest(ctx context.Context, cli *client.Client, prefix string) ([]byte, error) {
+	containers, err := GetPrefixedContainers(cli, prefix+"-")
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]string{}
+	inspected := []types.ContainerJSON{}
+	for _, c := range containers {
+		name := NodeName(prefix, c)
+		if name == "" {
+			continue
+		}
+		details, err := cli.ContainerInspect(ctx, c.ID)
+		if err != nil {
+			return nil, err
+		}
+		names[details.ID] = name
+		inspected = append(inspected, details)
+	}
+	sort.Slice(inspected, func(i, j int) bool {
+		return inspected[i].Created < inspected[j].Created
+	})
+
+	manifest := ClusterManifest{
+		Prefix:     prefix,
+		Containers: []ContainerManifest{},
+		Volumes:    []string{},
+	}
+
+	for _, details := range inspected {
+		config := details.Config
+		hostConfig := details.HostConfig
+
+		// Generated hostnames are the short container id, and containers joining a network
+		// namespace report the hostname of the namespace owner
+		if strings.HasPrefix(details.ID, config.Hostname) || hostConfig.NetworkMode.IsContainer() {
+			config.Hostname = ""
+		}
+
+		if hostConfig.NetworkMode.IsContainer() {
+			target := hostConfig.NetworkMode.ConnectedContainer()
+			if name, exists := names[target]; exists {
+				hostConfig.NetworkMode = container.NetworkMode("container:" + name)
+			}
+		}
+		for i, m := range hostConfig.Mounts {
+			if m.Type == mount.TypeVolume {
+				hostConfig.Mounts[i].Source = strings.TrimPrefix(m.Source, prefix+"-")
+			}
+		}
+
+		networks := []string{}
+		if details.NetworkSettings != nil {
+			for network := range details.NetworkSettings.Networks {
+				if network != "bridge" && network != string(hostConfig.NetworkMode) {
+					networks = append(networks, network)
+				}
+			}
+		}
+		sort.Strings(networks)
+
+		manifest.Containers = append(manifest.Containers, ContainerManifest{
+			Name:       names[details.ID],
+			Config:     config,
+			HostConfig: hostConfig,
+			Networks:   networks,
+		})
+	}
+
+	volumes, err := GetVolumesByLabels(ctx, cli, map[string]string{LABEL_CLUSTER: prefix})
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range volumes {
+		manifest.Volumes = append(manifest.Volumes, strings.TrimPrefix(v.Name, prefix+"-"))
+	}
+	sort.Strings(manifest.Volumes)
+
+	return json.MarshalIndent(manifest, "", "  ")
+}
+
+// ImportClusterManifest creates and starts the volumes and containers of a manifest from
+// ExportClusterManifest under the given prefix, or under the original one if prefix is empty.
+// Like in run, everything created is reported to the cleanup handler channels.
+func ImportClusterManifest(ctx context.Context, cli *client.Client, data []byte, prefix string, containers chan string, volumes chan string) error {
+	manifest := ClusterManifest{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("invalid cluster manifest: %v", err)
+	}
+	if prefix == "" {
+		prefix = manifest.Prefix
+	}
+
+	for _, name := range manifest.Volumes {
+		vol, err := CreateVolume(ctx, cli, prefix, name)
+		if err != nil {
+			return err
+		}
+		volumes <- vol.Name
+	}
+
+	ids := map[string]string{}
+	for _, c := range manifest.Containers {
+		config := c.Config
+		hostConfig := c.HostConfig
+		if config == nil || hostConfig == nil {
+			return fmt.Errorf("container %s in the cluster manifest is incomplete", c.Name)
+		}
+
+		if config.Labels == nil {
+			config.Labels = map[string]string{}
+		}
+		if _, exists := config.Labels[LABEL_CLUSTER]; exists {
+			config.Labels[LABEL_CLUSTER] = prefix
+		}
+
+		if hostConfig.NetworkMode.IsContainer() {
+			target := hostConfig.NetworkMode.ConnectedContainer()
+			id, exists := ids[target]
+			if !exists {
+				return fmt.Errorf("container %s joins the network of unknown container %s", c.Name, target)
+			}
+			hostConfig.NetworkMode = container.NetworkMode("container:" + id)
+		}
+		for i, m := range hostConfig.Mounts {
+			if m.Type == mount.TypeVolume {
+				hostConfig.Mounts[i].Source = prefix + "-" + m.Source
+			}
+		}
+
+		created, err := cli.ContainerCreate(ctx, config, hostConfig, nil, prefix+"-"+c.Name)
+		if client.IsErrImageNotFound(err) {
+			reader, pullErr := cli.ImagePull(ctx, config.Image, types.ImagePullOptions{})
+			if pullErr != nil {
+				return pullErr
+			}
+			PrintProgress(reader, os.Stdout)
+			created, err = cli.ContainerCreate(ctx, config, hostConfig, nil, prefix+"-"+c.Name)
+		}
+		if err != nil {
+			return err
+		}
+		containers <- created.ID
+		ids[c.Name] = created.ID
+
+		for _, network := range c.Networks {
+			if err := cli.NetworkConnect(ctx, network, created.ID, nil); err != nil {
+				return err
+			}
+		}
+
+		if err := cli.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
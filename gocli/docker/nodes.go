@@ -0,0 +1,402 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hostsBegin = "# BEGIN kubevirtci nodes"
+	hostsEnd   = "# END kubevirtci nodes"
+)
+
+// NodeIP returns the address of a node VM in the cluster network, see dnsmasq.sh.
+func NodeIP(nodeName string) string {
+	return "192.168.66.1" + strings.TrimPrefix(nodeName, "node")
+}
+
+// SSHCommand returns the ssh command to connect to the vagrant user of a node VM through
+// the published ssh port of the node. vm.sh forwards container port 22<node number> to each node,
+// run exposes these ports for all nodes and docker publishes them on the dnsmasq container.
+// The node VMs get new host keys with every cluster, so they are not checked.
+func SSHCommand(ctx context.Context, cli *client.Client, prefix string, nodeIndex int) (string, error) {
+	return sshCommand(ctx, cli, prefix, nodeIndex, "")
+}
+
+// SSHCommandWithKey is like SSHCommand, but passes the key at keyPath to ssh. This is the vagrant
+// key of the cluster, base/vagrant.key in this repository.
+func SSHCommandWithKey(ctx context.Context, cli *client.Client, prefix string, nodeIndex int, keyPath string) (string, error) {
+	return sshCommand(ctx, cli, prefix, nodeIndex, keyPath)
+}
+
+func sshCommand(ctx context.Context, cli *client.Client, prefix string, nodeIndex int, keyPath string) (string, error) {
+	dnsmasq, err := cli.ContainerInspect(ctx, prefix+"-dnsmasq")
+	if err != nil {
+		return "", err
+	}
+
+	sshPort := nat.Port(fmt.Sprintf("%d/tcp", 2200+nodeIndex))
+	for _, binding := range dnsmasq.NetworkSettings.Ports[sshPort] {
+		if binding.HostPort == "" {
+			continue
+		}
+		ip := binding.HostIP
+		if ip == "" || ip == "0.0.0.0" {
+			ip = "127.0.0.1"
+		}
+		command := "ssh"
+		if keyPath != "" {
+			command += " -i " + keyPath
+		}
+		return fmt.Sprintf("%s -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no -p %s vagrant@%s", command, binding.HostPort, ip), nil
+	}
+	return "", fmt.Errorf("ssh port %s of node%02d is not published", sshPort, nodeIndex)
+}
+
+// SyncHosts writes an entry for every node of the cluster into the /etc/hosts file of all node VMs.
+// Entries from previous runs are replaced, the rest of the file is left untouched.
+func SyncHosts(ctx context.Context, cli *client.Client, prefix string) error {
+	nodes, err := GetNodeContainers(cli, prefix)
+	if err != nil {
+		return err
+	}
+
+	entries := []string{hostsBegin}
+	for _, node := range nodes {
+		name := NodeName(prefix, node)
+		entries = append(entries, fmt.Sprintf("%s %s", NodeIP(name), name))
+	}
+	entries = append(entries, hostsEnd)
+
+	script := fmt.Sprintf("sed -i '/^%s$/,/^%s$/d' /etc/hosts\ncat >> /etc/hosts <<EOF\n%s\nEOF\n", hostsBegin, hostsEnd, strings.Join(entries, "\n"))
+
+	for _, node := range nodes {
+		var out bytes.Buffer
+		exitCode, err := execWithExitCode(ctx, cli, node.ID, []string{"/bin/bash", "-c", `echo "$0" | ssh.sh sudo /bin/bash`, script}, &out)
+		if err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			return fmt.Errorf("updating /etc/hosts on node %s failed: %s", NodeName(prefix, node), out.String())
+		}
+	}
+	return nil
+}
+
+type ExecResult struct {
+	Node     string
+	ExitCode int
+	Output   string
+	// StartTime and Duration show which node slowed a batch down
+	StartTime time.Time
+	Duration  time.Duration
+}
+
+// ExecOnEach runs the command on all node containers, one after another in node order.
+// If stopOnError is set, it returns the results collected so far together with an
+// error as soon as the command fails on a node.
+func ExecOnEach(ctx context.Context, cli *client.Client, prefix string, args []string, stopOnError bool) ([]ExecResult, error) {
+	nodes, err := GetNodeContainers(cli, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []ExecResult{}
+	for _, node := range nodes {
+		var out bytes.Buffer
+		start := time.Now()
+		exitCode, err := execWithExitCode(ctx, cli, node.ID, args, &out)
+		if err != nil {
+			return results, err
+		}
+
+		result := ExecResult{
+			Node:      NodeName(prefix, node),
+			ExitCode:  exitCode,
+			Output:    out.String(),
+			StartTime: start,
+			Duration:  time.Since(start),
+		}
+		results = append(results, result)
+
+		if stopOnError && exitCode != 0 {
+			return results, fmt.Errorf("command %v failed on node %s with exit code %d", args, result.Node, exitCode)
+		}
+	}
+	return results, nil
+}
+
+// CollectKubeletLogs writes the kubelet journal of every node VM to the writer returned by out for that node.
+func CollectKubeletLogs(ctx context.Context, cli *client.Client, prefix string, out func(node string) io.Writer) error {
+	nodes, err := GetNodeContainers(cli, prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range nodes {
+		name := NodeName(prefix, node)
+		writer := out(name)
+		exitCode, err := execAttached(ctx, cli, node.ID, []string{"ssh.sh", "sudo", "journalctl", "-u", "kubelet", "--no-pager"}, false, writer, writer)
+		if err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			return fmt.Errorf("collecting kubelet logs from node %s failed with exit code %d", name, exitCode)
+		}
+	}
+	return nil
+}
+
+// ProxyEnv returns the proxy environment variables, in upper and lower case, for all non-empty settings.
+func ProxyEnv(httpProxy string, httpsProxy string, noProxy string) []string {
+	env := []string{}
+	for _, v := range []struct{ name, value string }{
+		{"HTTP_PROXY", httpProxy},
+		{"HTTPS_PROXY", httpsProxy},
+		{"NO_PROXY", noProxy},
+	} {
+		if v.value != "" {
+			env = append(env, v.name+"="+v.value, strings.ToLower(v.name)+"="+v.value)
+		}
+	}
+	return env
+}
+
+// ConfigureDockerProxy makes docker inside the node VM use the proxy environment, if docker is installed there.
+func ConfigureDockerProxy(ctx context.Context, cli *client.Client, container string, proxyEnv []string) error {
+	environment := []string{}
+	for _, e := range proxyEnv {
+		environment = append(environment, fmt.Sprintf("Environment=\"%s\"", e))
+	}
+
+	script := fmt.Sprintf(`if systemctl cat docker.service >/dev/null 2>&1; then
+mkdir -p /etc/systemd/system/docker.service.d
+cat > /etc/systemd/system/docker.service.d/http-proxy.conf <<EOF
+[Service]
+%s
+EOF
+systemctl daemon-reload
+systemctl restart docker
+fi
+`, strings.Join(environment, "\n"))
+
+	var out bytes.Buffer
+	exitCode, err := execWithExitCode(ctx, cli, container, []string{"/bin/bash", "-c", `echo "$0" | ssh.sh sudo /bin/bash`, script}, &out)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("configuring the docker proxy in container %s failed: %s", container, out.String())
+	}
+	return nil
+}
+
+type UpgradeOptions struct {
+	// Sequential upgrades one node after another, otherwise all nodes are upgraded at once
+	Sequential bool
+	// StopTimeout is how long a node gets to shut down before it is killed, zero uses the
+	// stop timeout of the node container
+	StopTimeout time.Duration
+}
+
+// UpgradeNodes recreates the node containers one after another from newImage. The configuration of
+// each node is kept, and its disk survives in the node volume. Environment variables and labels which
+// the node only inherited from its old image are dropped, so that the new image can provide its own.
+// The new node is created before the old one is stopped and removed, so a node whose replacement can't
+// be created is left running.
+func UpgradeNodes(ctx context.Context, cli *client.Client, prefix string, newImage string) error {
+	return UpgradeNodesWithOptions(ctx, cli, prefix, newImage, UpgradeOptions{Sequential: true})
+}
+
+// UpgradeNodesWithOptions upgrades the nodes like UpgradeNodes according to options.
+func UpgradeNodesWithOptions(ctx context.Context, cli *client.Client, prefix string, newImage string, options UpgradeOptions) error {
+	nodes, err := GetNodeContainers(cli, prefix)
+	if err != nil {
+		return err
+	}
+
+	var stopTimeout *time.Duration
+	if options.StopTimeout > 0 {
+		stopTimeout = &options.StopTimeout
+	}
+
+	if options.Sequential {
+		for _, node := range nodes {
+			if err := upgradeNode(ctx, cli, prefix, node, newImage, stopTimeout); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	errs := make(chan error, len(nodes))
+	wg := sync.WaitGroup{}
+	wg.Add(len(nodes))
+	for _, node := range nodes {
+		go func(node types.Container) {
+			defer wg.Done()
+			if err := upgradeNode(ctx, cli, prefix, node, newImage, stopTimeout); err != nil {
+				errs <- err
+			}
+		}(node)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+func upgradeNode(ctx context.Context, cli *client.Client, prefix string, node types.Container, newImage string, stopTimeout *time.Duration) error {
+	name := NodeName(prefix, node)
+	details, err := cli.ContainerInspect(ctx, node.ID)
+	if err != nil {
+		return err
+	}
+	oldImage, _, err := cli.ImageInspectWithRaw(ctx, details.Image)
+	if err != nil {
+		return err
+	}
+
+	config := details.Config
+	config.Image = newImage
+	// Nodes join the network namespace of dnsmasq and can't have their own hostname
+	if details.HostConfig.NetworkMode.IsContainer() {
+		config.Hostname = ""
+	}
+	if oldImage.Config != nil {
+		config.Env = withoutInherited(config.Env, oldImage.Config.Env)
+		labels := map[string]string{}
+		for key, value := range config.Labels {
+			if inherited, exists := oldImage.Config.Labels[key]; !exists || inherited != value {
+				labels[key] = value
+			}
+		}
+		config.Labels = labels
+	}
+
+	containerName := prefix + "-" + name
+	created, err := cli.ContainerCreate(ctx, config, details.HostConfig, nil, containerName+"-upgrade")
+	if err != nil {
+		return fmt.Errorf("creating the new node %s failed: %v", name, err)
+	}
+
+	// The VM gets the stop signal first, so that it can shut down before its disk is taken over
+	if err := cli.ContainerStop(ctx, node.ID, stopTimeout); err != nil {
+		cli.ContainerRemove(ctx, created.ID, types.ContainerRemoveOptions{})
+		return fmt.Errorf("stopping the old node %s failed: %v", name, err)
+	}
+	if err := cli.ContainerRemove(ctx, node.ID, types.ContainerRemoveOptions{}); err != nil {
+		cli.ContainerRemove(ctx, created.ID, types.ContainerRemoveOptions{})
+		return err
+	}
+	if err := cli.ContainerRename(ctx, created.ID, containerName); err != nil {
+		return fmt.Errorf("renaming the new node %s failed: %v", name, err)
+	}
+	return cli.ContainerStart(ctx, created.ID, types.ContainerStartOptions{})
+}
+
+// withoutInherited returns the variables of env which are not set to the same value in inherited
+func withoutInherited(env []string, inherited []string) []string {
+	result := []string{}
+	for _, variable := range env {
+		if !containsString(inherited, variable) {
+			result = append(result, variable)
+		}
+	}
+	return result
+}
+
+// RollingRestart restarts the nodes one after another and waits for readyCheck to succeed for
+// each node before the next one is restarted.
+func RollingRestart(ctx context.Context, cli *client.Client, prefix string, readyCheck func(container string) error) error {
+	nodes, err := GetNodeContainers(cli, prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range nodes {
+		name := NodeName(prefix, node)
+		if err := cli.ContainerRestart(ctx, node.ID, nil); err != nil {
+			return fmt.Errorf("restarting node %s failed: %v", name, err)
+		}
+		if err := readyCheck(prefix + "-" + name); err != nil {
+			return fmt.Errorf("node %s did not become ready after restart: %v", name, err)
+		}
+	}
+	return nil
+}
+
+const (
+	// LABEL_ROLE overrides the role of a container derived from its name
+	LABEL_ROLE = "io.kubevirtci.role"
+
+	ROLE_CONTROL_PLANE = "control-plane"
+	ROLE_WORKER        = "worker"
+	ROLE_INFRA         = "infra"
+)
+
+var infraContainers = []string{"dnsmasq", "registry", "nfs-ganesha", "fluentd"}
+
+// GroupByRole groups cluster containers into control-plane, worker and infra containers. node01 runs
+// the control plane, all other nodes are workers, and dnsmasq, registry, nfs and logging are infra.
+func GroupByRole(containers []types.Container) (map[string][]types.Container, error) {
+	groups := map[string][]types.Container{}
+	for _, c := range containers {
+		role, err := containerRole(c)
+		if err != nil {
+			return nil, err
+		}
+		groups[role] = append(groups[role], c)
+	}
+	return groups, nil
+}
+
+func containerRole(c types.Container) (string, error) {
+	if role, exists := c.Labels[LABEL_ROLE]; exists {
+		return role, nil
+	}
+
+	for _, name := range c.Names {
+		if strings.HasSuffix(name, "-node01") {
+			return ROLE_CONTROL_PLANE, nil
+		}
+		if i := strings.LastIndex(name, "-"); i >= 0 && nodeNamePattern.MatchString(name[i+1:]) {
+			return ROLE_WORKER, nil
+		}
+		for _, infra := range infraContainers {
+			if strings.HasSuffix(name, "-"+infra) {
+				return ROLE_INFRA, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("could not determine the role of container %v", c.Names)
+}
+
+// VerifyNodeCount returns an error listing the present nodes if the cluster does not have the expected
+// number of running node containers. Nodes which failed to start are listed, but not counted.
+func VerifyNodeCount(ctx context.Context, cli *client.Client, prefix string, expected int) error {
+	nodes, err := GetNodeContainers(cli, prefix)
+	if err != nil {
+		return err
+	}
+
+	running := 0
+	present := []string{}
+	for _, node := range nodes {
+		if node.State == "running" {
+			running++
+		}
+		present = append(present, fmt.Sprintf("%s (%s)", NodeName(prefix, node), node.State))
+	}
+	if running != expected {
+		return fmt.Errorf("cluster %s has %d running nodes, expected %d, present nodes: %s", prefix, running, expected, strings.Join(present, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package docker
+
+import (
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/go-connections/nat"
+	"reflect"
+	"testing"
+)
+
+func TestGroupByRole(t *testing.T) {
+	container := func(name string, labels map[string]string) types.Container {
+		return types.Container{Names: []string{"/" + name}, Labels: labels}
+	}
+
+	tests := []struct {
+		name       string
+		containers []types.Container
+		want       map[string][]string
+		wantErr    bool
+	}{
+		{
+			name:       "no containers",
+			containers: []types.Container{},
+			want:       map[string][]string{},
+		},
+		{
+			name: "roles from names",
+			containers: []types.Container{
+				container("k8s-dnsmasq", nil),
+				container("k8s-node01", nil),
+				container("k8s-node02", nil),
+				container("k8s-node10", nil),
+				container("k8s-registry", nil),
+				container("k8s-nfs-ganesha", nil),
+				container("k8s-fluentd", nil),
+			},
+			want: map[string][]string{
+				ROLE_CONTROL_PLANE: {"/k8s-node01"},
+				ROLE_WORKER:        {"/k8s-node02", "/k8s-node10"},
+				ROLE_INFRA:         {"/k8s-dnsmasq", "/k8s-registry", "/k8s-nfs-ganesha", "/k8s-fluentd"},
+			},
+		},
+		{
+			name: "label overrides the name",
+			containers: []types.Container{
+				container("k8s-node02", map[string]string{LABEL_ROLE: ROLE_CONTROL_PLANE}),
+				container("k8s-tools", map[string]string{LABEL_ROLE: ROLE_INFRA}),
+			},
+			want: map[string][]string{
+				ROLE_CONTROL_PLANE: {"/k8s-node02"},
+				ROLE_INFRA:         {"/k8s-tools"},
+			},
+		},
+		{
+			name:       "unknown container",
+			containers: []types.Container{container("k8s-tools", nil)},
+			wantErr:    true,
+		},
+		{
+			name:       "node without number",
+			containers: []types.Container{container("k8s-nodexx", nil)},
+			wantErr:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			groups, err := GroupByRole(test.containers)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("expected error %v, got %v", test.wantErr, err)
+			}
+			if test.wantErr {
+				return
+			}
+			names := map[string][]string{}
+			for role, containers := range groups {
+				for _, c := range containers {
+					names[role] = append(names[role], c.Names[0])
+				}
+			}
+			if !reflect.DeepEqual(names, test.want) {
+				t.Errorf("expected %v, got %v", test.want, names)
+			}
+		})
+	}
+}
+
+func TestSSHCommand(t *testing.T) {
+	dnsmasq := func(ports nat.PortMap) types.ContainerJSON {
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{Name: "/kubevirt-dnsmasq"},
+			NetworkSettings:   &types.NetworkSettings{NetworkSettingsBase: types.NetworkSettingsBase{Ports: ports}},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		ports   nat.PortMap
+		keyPath string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "published on all addresses",
+			ports: nat.PortMap{"2202/tcp": {{HostIP: "0.0.0.0", HostPort: "32022"}}},
+			want:  "ssh -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no -p 32022 vagrant@127.0.0.1",
+		},
+		{
+			name:    "published on one address with a key",
+			ports:   nat.PortMap{"2202/tcp": {{HostIP: "10.0.0.1", HostPort: "32022"}}},
+			keyPath: "vagrant.key",
+			want:    "ssh -i vagrant.key -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no -p 32022 vagrant@10.0.0.1",
+		},
+		{
+			name:    "exposed but not published",
+			ports:   nat.PortMap{"2202/tcp": nil},
+			wantErr: true,
+		},
+		{
+			name:    "port of another node",
+			ports:   nat.PortMap{"2201/tcp": {{HostPort: "32021"}}},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cli, stop := fakeDaemon(t, dnsmasq(test.ports))
+			defer stop()
+
+			got, err := SSHCommandWithKey(context.Background(), cli, "kubevirt", 2, test.keyPath)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types/versions"
+	"github.com/docker/docker/client"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// PreflightOptions selects the checks PreflightChecks runs, zero values skip a check.
+// Like GetCgroupVersion, the KVM, disk, port and cgroup checks look at the local host, so
+// they are skipped unless the docker daemon runs locally.
+type PreflightOptions struct {
+	RequireKVM bool
+	// MinDiskSpace is the free space in bytes needed in the docker root directory
+	MinDiskSpace int64
+	// Ports which have to be free on the host, 0 stands for a random port and is not checked
+	Ports []int
+	// MinAPIVersion is the oldest docker API version the daemon has to support
+	MinAPIVersion string
+	// CgroupVersions are the supported cgroup versions, any version is accepted if empty
+	CgroupVersions []int
+}
+
+type CheckResult struct {
+	Name   string
+	Passed bool
+	// Skipped checks could not be run against the daemon, they neither passed nor failed
+	Skipped bool
+	Message string
+}
+
+// PreflightChecks runs all selected checks and returns their results. An error is only
+// returned if the docker daemon can't be reached at all.
+func PreflightChecks(ctx context.Context, cli *client.Client, opts PreflightOptions) ([]CheckResult, error) {
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []CheckResult{}
+	local := daemonIsLocal()
+	skipped := func(name string) CheckResult {
+		return CheckResult{Name: name, Skipped: true, Message: "the docker daemon does not run on this host"}
+	}
+
+	if opts.RequireKVM && !local {
+		results = append(results, skipped("KVM"))
+	} else if opts.RequireKVM {
+		results = append(results, checkKVM())
+	}
+
+	if opts.MinDiskSpace > 0 && !local {
+		results = append(results, skipped("disk space"))
+	} else if opts.MinDiskSpace > 0 {
+		result := CheckResult{Name: "disk space"}
+		stat := syscall.Statfs_t{}
+		if err := syscall.Statfs(info.DockerRootDir, &stat); err != nil {
+			result.Message = fmt.Sprintf("checking free space in %s failed: %v", info.DockerRootDir, err)
+		} else if free := int64(stat.Bavail) * int64(stat.Bsize); free < opts.MinDiskSpace {
+			result.Message = fmt.Sprintf("%d bytes free in %s, %d are needed", free, info.DockerRootDir, opts.MinDiskSpace)
+		} else {
+			result.Passed = true
+			result.Message = fmt.Sprintf("%d bytes free in %s", free, info.DockerRootDir)
+		}
+		results = append(results, result)
+	}
+
+	for _, port := range opts.Ports {
+		if port <= 0 {
+			continue
+		}
+		result := CheckResult{Name: fmt.Sprintf("port %d", port)}
+		if !local {
+			results = append(results, skipped(result.Name))
+			continue
+		}
+		conflicts, err := CheckPortRangeAvailable(port, 1)
+		if err != nil {
+			result.Message = err.Error()
+		} else if len(conflicts) > 0 {
+			result.Message = fmt.Sprintf("port %d is already in use", port)
+		} else {
+			result.Passed = true
+			result.Message = fmt.Sprintf("port %d is free", port)
+		}
+		results = append(results, result)
+	}
+
+	if opts.MinAPIVersion != "" {
+		result := CheckResult{Name: "API version"}
+		version, err := cli.ServerVersion(ctx)
+		if err != nil {
+			result.Message = fmt.Sprintf("reading the docker version failed: %v", err)
+		} else if versions.LessThan(version.APIVersion, opts.MinAPIVersion) {
+			result.Message = fmt.Sprintf("docker daemon supports API version %s, at least %s is needed", version.APIVersion, opts.MinAPIVersion)
+		} else {
+			result.Passed = true
+			result.Message = fmt.Sprintf("docker daemon supports API version %s", version.APIVersion)
+		}
+		results = append(results, result)
+	}
+
+	if !local {
+		results = append(results, skipped("cgroup version"))
+		return results, nil
+	}
+	result := CheckResult{Name: "cgroup version"}
+	cgroupVersion, err := GetCgroupVersion(ctx, cli)
+	if err != nil {
+		result.Message = err.Error()
+	} else {
+		result.Passed = len(opts.CgroupVersions) == 0
+		for _, v := range opts.CgroupVersions {
+			if v == cgroupVersion {
+				result.Passed = true
+			}
+		}
+		if result.Passed {
+			result.Message = fmt.Sprintf("cgroup v%d", cgroupVersion)
+		} else {
+			result.Message = fmt.Sprintf("cgroup v%d is not supported, supported are %v", cgroupVersion, opts.CgroupVersions)
+		}
+	}
+	results = append(results, result)
+
+	return results, nil
+}
+
+// daemonIsLocal returns whether the docker daemon runs on this host, which is assumed when the
+// client connects to it through a unix socket on linux
+func daemonIsLocal() bool {
+	host := os.Getenv("DOCKER_HOST")
+	return runtime.GOOS == "linux" && (host == "" || strings.HasPrefix(host, "unix://"))
+}
+
+// checkKVM uses the same check as vm.sh, which creates /dev/kvm from /proc/misc when it is missing
+func checkKVM() CheckResult {
+	result := CheckResult{Name: "KVM"}
+	if _, err := os.Stat("/dev/kvm"); err == nil {
+		result.Passed = true
+		result.Message = "/dev/kvm is available"
+		return result
+	}
+	misc, err := ioutil.ReadFile("/proc/misc")
+	if err != nil {
+		result.Message = fmt.Sprintf("/dev/kvm does not exist and /proc/misc can't be read: %v", err)
+		return result
+	}
+	for _, line := range strings.Split(string(misc), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == "kvm" {
+			result.Passed = true
+			result.Message = "the kvm device is registered in /proc/misc"
+			return result
+		}
+	}
+	result.Message = "KVM is not available, check that virtualization is enabled and the kvm modules are loaded"
+	return result
+}
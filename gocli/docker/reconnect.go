@@ -0,0 +1,62 @@
+package docker
+
+import (
+	"github.com/docker/docker/client"
+	"strings"
+	"sync"
+)
+
+// ReconnectingClient keeps a docker client usable across restarts of the docker daemon.
+type ReconnectingClient struct {
+	lock sync.Mutex
+	cli  *client.Client
+}
+
+func NewReconnectingClient() (*ReconnectingClient, error) {
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	return &ReconnectingClient{cli: cli}, nil
+}
+
+// Client returns the current docker client.
+func (r *ReconnectingClient) Client() *client.Client {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.cli
+}
+
+// Reconnect replaces the docker client with a freshly connected one.
+func (r *ReconnectingClient) Reconnect() error {
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	old := r.cli
+	r.cli = cli
+	r.lock.Unlock()
+
+	old.Close()
+	return nil
+}
+
+// Do calls f with the current client. If the daemon could not be reached, it
+// reconnects and calls f once more.
+func (r *ReconnectingClient) Do(f func(cli *client.Client) error) error {
+	err := f(r.Client())
+	if err == nil || !isConnectionError(err) {
+		return err
+	}
+
+	if err := r.Reconnect(); err != nil {
+		return err
+	}
+	return f(r.Client())
+}
+
+func isConnectionError(err error) bool {
+	return client.IsErrConnectionFailed(err) || strings.Contains(err.Error(), "connection refused")
+}
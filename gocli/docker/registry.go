@@ -0,0 +1,113 @@
+package docker
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// registryPort is the port of the cluster registry, which is published on the dnsmasq container
+const registryPort = 5000
+
+// RegistryAddress returns the host and port under which the registry of the cluster is published.
+func RegistryAddress(cli *client.Client, prefix string) (string, error) {
+	dnsmasq, err := GetDDNSMasqContainer(cli, prefix)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range dnsmasq.Ports {
+		if p.PrivatePort == registryPort && p.PublicPort != 0 {
+			ip := p.IP
+			if ip == "" || ip == "0.0.0.0" {
+				ip = "127.0.0.1"
+			}
+			return ip + ":" + strconv.Itoa(int(p.PublicPort)), nil
+		}
+	}
+	return "", fmt.Errorf("registry port of cluster %s is not published", prefix)
+}
+
+// CheckRegistry returns an error if the registry of the cluster does not answer on its published port.
+func CheckRegistry(ctx context.Context, cli *client.Client, prefix string) error {
+	address, err := RegistryAddress(cli, prefix)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+address+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+	httpClient := http.Client{Timeout: 10 * time.Second}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("registry of cluster %s is not reachable on %s: %v", prefix, address, err)
+	}
+	defer resp.Body.Close()
+
+	// A registry with authentication answers with 401, which still means it is up
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("registry of cluster %s on %s answered with %s", prefix, address, resp.Status)
+	}
+	return nil
+}
+
+// PushToClusterRegistry tags the local image as targetTag, like kubevirt/virt-operator:devel, in the
+// registry of the cluster and pushes it there while printing the progress. Docker treats registries
+// on localhost as insecure by default, so no daemon configuration is needed.
+func PushToClusterRegistry(ctx context.Context, cli *client.Client, prefix string, localRef string, targetTag string) error {
+	address, err := RegistryAddress(cli, prefix)
+	if err != nil {
+		return err
+	}
+	remoteRef := address + "/" + targetTag
+	if err := cli.ImageTag(ctx, localRef, remoteRef); err != nil {
+		return err
+	}
+
+	// The cluster registry has no authentication, but the daemon insists on the auth header
+	reader, err := cli.ImagePush(ctx, remoteRef, types.ImagePushOptions{
+		RegistryAuth: base64.URLEncoding.EncodeToString([]byte("{}")),
+	})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	progressReader, progressWriter := io.Pipe()
+	printed := make(chan struct{})
+	go func() {
+		PrintProgress(progressReader, os.Stdout)
+		close(printed)
+	}()
+
+	// Failures of the push are only reported in the progress stream
+	pushErr := ""
+	scanner := bufio.NewScanner(io.TeeReader(reader, progressWriter))
+	for scanner.Scan() {
+		msg := struct {
+			Error string `json:"error"`
+		}{}
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err == nil && msg.Error != "" {
+			pushErr = msg.Error
+		}
+	}
+	progressWriter.CloseWithError(scanner.Err())
+	<-printed
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if pushErr != "" {
+		return fmt.Errorf("pushing %s failed: %s", remoteRef, pushErr)
+	}
+	return nil
+}
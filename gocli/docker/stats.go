@@ -0,0 +1,112 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+type StatsSnapshot struct {
+	CPUPercent  float64
+	MemoryUsage uint64
+	MemoryLimit uint64
+}
+
+// StreamClusterStats collects the resource usage of all nodes every interval and passes it, keyed
+// by node name, to onUpdate. It returns when the context is done or stats can't be retrieved.
+func StreamClusterStats(ctx context.Context, cli *client.Client, prefix string, interval time.Duration, onUpdate func(map[string]StatsSnapshot)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		nodes, err := GetNodeContainers(cli, prefix)
+		if err != nil {
+			return err
+		}
+
+		snapshots := map[string]StatsSnapshot{}
+		errs := make(chan error, len(nodes))
+		lock := sync.Mutex{}
+		wg := sync.WaitGroup{}
+		wg.Add(len(nodes))
+		for _, node := range nodes {
+			go func(node types.Container) {
+				defer wg.Done()
+				snapshot, err := getStatsSnapshot(ctx, cli, node.ID)
+				if err != nil {
+					errs <- err
+					return
+				}
+				lock.Lock()
+				snapshots[NodeName(prefix, node)] = snapshot
+				lock.Unlock()
+			}(node)
+		}
+		wg.Wait()
+		close(errs)
+		if err := <-errs; err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		onUpdate(snapshots)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+type onlineCPUs struct {
+	CPUStats struct {
+		OnlineCPUs uint32 `json:"online_cpus"`
+	} `json:"cpu_stats"`
+}
+
+func getStatsSnapshot(ctx context.Context, cli *client.Client, container string) (StatsSnapshot, error) {
+	resp, err := cli.ContainerStats(ctx, container, false)
+	if err != nil {
+		return StatsSnapshot{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return StatsSnapshot{}, err
+	}
+	stats := types.StatsJSON{}
+	if err := json.Unmarshal(body, &stats); err != nil {
+		return StatsSnapshot{}, err
+	}
+	// The vendored API predates online_cpus, which newer daemons report instead of the per cpu usage
+	online := onlineCPUs{}
+	if err := json.Unmarshal(body, &online); err != nil {
+		return StatsSnapshot{}, err
+	}
+	cpus := float64(online.CPUStats.OnlineCPUs)
+	if cpus == 0 {
+		cpus = float64(len(stats.CPUStats.CPUUsage.PercpuUsage))
+	}
+
+	// Same calculation as `docker stats`
+	cpuPercent := 0.0
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemUsage) - float64(stats.PreCPUStats.SystemUsage)
+	if cpuDelta > 0 && systemDelta > 0 {
+		cpuPercent = cpuDelta / systemDelta * cpus * 100
+	}
+
+	return StatsSnapshot{
+		CPUPercent:  cpuPercent,
+		MemoryUsage: stats.MemoryStats.Usage,
+		MemoryLimit: stats.MemoryStats.Limit,
+	}, nil
+}
@@ -0,0 +1,131 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/docker/client"
+	"io/ioutil"
+	"time"
+)
+
+type ClusterState string
+
+const (
+	// STATE_NOT_FOUND means that neither dnsmasq nor any node of the cluster exists
+	STATE_NOT_FOUND ClusterState = "NOT_FOUND"
+	// STATE_PARTIAL means that dnsmasq or nodes are missing or stopped
+	STATE_PARTIAL ClusterState = "PARTIAL"
+	// STATE_STARTING means that all containers run, but the cluster is not ready yet
+	STATE_STARTING ClusterState = "STARTING"
+	STATE_READY    ClusterState = "READY"
+	// STATE_DEGRADED means that the cluster is not ready and containers are or were restarting
+	STATE_DEGRADED ClusterState = "DEGRADED"
+)
+
+// ClusterStatus classifies the state of the cluster from its containers and readiness checks. The
+// cluster is ready once every node VM is reachable and the API server on node01 is healthy. Until
+// then it counts as starting, unless docker had to restart one of its containers.
+func ClusterStatus(ctx context.Context, cli *client.Client, prefix string) (ClusterState, error) {
+	candidates, err := GetPrefixedContainers(cli, prefix+"-dnsmasq")
+	if err != nil {
+		return "", err
+	}
+	nodes, err := GetNodeContainers(cli, prefix)
+	if err != nil {
+		return "", err
+	}
+
+	dnsmasqRunning := false
+	dnsmasqFound := false
+	for _, c := range candidates {
+		if NodeName(prefix, c) == "dnsmasq" {
+			dnsmasqFound = true
+			dnsmasqRunning = c.State == "running"
+		}
+	}
+	if !dnsmasqFound && len(nodes) == 0 {
+		return STATE_NOT_FOUND, nil
+	}
+	if !dnsmasqRunning || len(nodes) == 0 {
+		return STATE_PARTIAL, nil
+	}
+
+	restarted := false
+	for _, node := range nodes {
+		switch node.State {
+		case "running":
+		case "restarting":
+			return STATE_DEGRADED, nil
+		default:
+			return STATE_PARTIAL, nil
+		}
+		restarts, err := GetRestartCount(ctx, cli, node.ID)
+		if err != nil {
+			return "", err
+		}
+		if restarts > 0 {
+			restarted = true
+		}
+	}
+
+	notReady := STATE_STARTING
+	if restarted {
+		notReady = STATE_DEGRADED
+	}
+
+	for _, node := range nodes {
+		exitCode, err := execAttached(ctx, cli, node.ID, []string{"test", "-f", "/ssh_ready"}, false, ioutil.Discard, ioutil.Discard)
+		if err != nil {
+			if _, stopped := err.(ErrContainerNotRunning); stopped {
+				return STATE_PARTIAL, nil
+			}
+			return "", err
+		}
+		if exitCode != 0 {
+			return notReady, nil
+		}
+	}
+
+	if err := WaitForAPIHealthz(ctx, cli, prefix, 10*time.Second); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return notReady, nil
+	}
+	return STATE_READY, nil
+}
+
+// ClusterReady returns whether ClusterStatus considers the cluster ready.
+func ClusterReady(ctx context.Context, cli *client.Client, prefix string) (bool, error) {
+	state, err := ClusterStatus(ctx, cli, prefix)
+	if err != nil {
+		return false, err
+	}
+	return state == STATE_READY, nil
+}
+
+// MeasureStartupTime polls ClusterReady until the cluster is ready and returns the time passed
+// since start, which is usually taken right before the cluster was run.
+func MeasureStartupTime(ctx context.Context, cli *client.Client, prefix string, start time.Time, timeout time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		ready, err := ClusterReady(ctx, cli, prefix)
+		if ctx.Err() != nil {
+			return 0, fmt.Errorf("cluster %s did not become ready within %v", prefix, timeout)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if ready {
+			return time.Since(start), nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, fmt.Errorf("cluster %s did not become ready within %v", prefix, timeout)
+		case <-time.After(time.Second):
+		}
+	}
+}